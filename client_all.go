@@ -1,12 +1,14 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
 	"io"
-	"strings"
+	"log/slog"
+	"net"
+	"os"
+	"time"
 )
 
 // ClientDialAndHandshake - start the ipc client and return when connected or connection failed
@@ -27,20 +29,20 @@ func DialAndHandshakeWithCallback(ipcName string, config *ClientConfig, onConnec
 		return nil, err
 	}
 
-	if onConnectionStatusChanged != nil {
-		c.callback = onConnectionStatusChanged
-	} else {
-		c.callback = defaultCallbackOnStatusChange
-	}
-	go c.CallbackOnStatusChange(c.callback)
+	c.notifyStatusChanges(onConnectionStatusChanged)
 
-	dialToServer(c)
+	err = dialToServer(c)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not connect to server: %w", err)
+	}
 	err = c.StartProcessingMessages()
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
 
-	log.Debugf("client: successfully waited, client is now '%s'", c.status)
+	c.log.Debug("connected", "status", c.state.get())
 	return c, nil
 }
 
@@ -52,161 +54,378 @@ func DialAndHandshakeAsync(ipcName string, config *ClientConfig, onConnectionSta
 	if err != nil {
 		return nil, err
 	}
-	go c.CallbackOnStatusChange(onConnectionStatusChanged)
+	c.notifyStatusChanges(onConnectionStatusChanged)
 	go dialToServer(c)
 
-	log.Debugf("client starting in background...")
+	c.log.Debug("connecting in the background")
 	return c, nil
 }
 
+// StartProcessingMessages - starts sending and receiving messages over the connection (see DialAndHandshakeAsync)
 func (c *Client) StartProcessingMessages() error {
-	if c.status != CConnected {
+	if c.state.get() != CConnected {
 		return errors.New("client is not connected to server")
 	}
-	go c.clientReadDataFromConnectionToIncomingChannel()
-	go c.clientWriteDataFromOutgoingChannelToConnection()
+	c.connMutex.Lock()
+	conn, reader := c.conn, c.connReader
+	c.connMutex.Unlock()
+
+	c.processMessages(conn, reader)
 	return nil
 }
 
-func defaultCallbackOnStatusChange(status ClientStatus) {
-	// nothing
+// processMessages starts the reading and writing goroutines of a connection
+func (c *Client) processMessages(conn net.Conn, reader *connReader) {
+	log := withSubsystem(c.log.With("session", c.state.session(), "peer_pid", peerPID(conn)), SubsystemFraming)
+	connDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	go c.clientReadDataFromConnectionToIncomingChannel(conn, reader, log, connDone, writerDone)
+	go c.clientWriteDataFromOutgoingChannelToConnection(conn, log, connDone, writerDone)
+}
+
+// Subscribe - returns a channel receiving each following status change of the client (in order),
+// it is closed after CClosed or when cancel is called. Subscribers don't block the client nor each other,
+// events for a slow subscriber are queued.
+func (c *Client) Subscribe() (events <-chan StatusEvent, cancel func()) {
+	return c.state.subscribe()
+}
+
+// WaitFor - blocks until the client's status satisfies predicate.
+// Returns an error if ctx is done or the status can't satisfy predicate anymore (e.g. CError or CTimeout after a failed dial, closed).
+func (c *Client) WaitFor(ctx context.Context, predicate func(ClientStatus) bool) error {
+	_, err := c.state.waitFor(ctx, predicate)
+	return err
+}
+
+// WaitConnected - blocks until the client is connected to the server (e.g. after DialAndHandshakeAsync, call StartProcessingMessages then).
+// Returns an error if connecting failed (CError, CTimeout), the client has been closed or ctx is done.
+func (c *Client) WaitConnected(ctx context.Context) error {
+	event, err := c.state.waitFor(ctx, func(status ClientStatus) bool {
+		return status == CConnected || status == CError || status == CTimeout
+	})
+	if err != nil {
+		return err
+	}
+	if ClientStatus(event.New) != CConnected {
+		if event.Err != nil {
+			return errors.New(fmt.Sprintf("client is '%s': %s", event.New, event.Err))
+		}
+		return errors.New(fmt.Sprintf("client is '%s'", event.New))
+	}
+	return nil
 }
+
+// CallbackOnStatusChange - calls onConnected with each following status change (in order) until the client is closed
+//
+// Deprecated: use Subscribe, which also tells the cause of a change.
 func (c *Client) CallbackOnStatusChange(onConnected func(ClientStatus)) {
-	for {
-		status := <-c.statusChannel
-		log.Statusf("client: client status is now '%s'", c.status)
+	events, cancel := c.Subscribe()
+	defer cancel()
+	for event := range events {
 		if onConnected != nil {
-			onConnected(status)
+			onConnected(ClientStatus(event.New))
 		}
 	}
 }
 
-func dialToServer(c *Client) {
-	log.Debugln("client: dialToServer")
-	c.status = CConnecting
-	c.statusChannel <- CConnecting
+// notifyStatusChanges subscribes right away (so no change gets lost) and calls onStatusChange in the background
+func (c *Client) notifyStatusChanges(onStatusChange func(ClientStatus)) {
+	if onStatusChange == nil {
+		return
+	}
+	events, _ := c.Subscribe() // closed after CClosed
+	go func() {
+		for event := range events {
+			onStatusChange(ClientStatus(event.New))
+		}
+	}()
+}
+
+// dialToServer connects the client for the first time, it returns why it couldn't
+func dialToServer(c *Client) error {
+	err := c.state.transition(CConnecting, nil)
+	if err != nil {
+		return errClientClosed // closed before connecting
+	}
 
-	err := c.clientDialAndHandshakeToServer()
+	err = c.dialAndHandshake()
 	if err != nil {
-		log.Fatal(err)
-		c.status = CError
-		c.statusChannel <- CError
-		return
+		withSubsystem(c.log, SubsystemReconnect).Warn("could not connect to server", "error", err)
+		c.failedToConnect(err)
+		return err
+	}
+	err = c.state.transitionToNewSession(CConnected)
+	if err != nil {
+		return errClientClosed // closed meanwhile, Close closes the connection
 	}
-	c.status = CConnected
-	log.Debugln("client BEFORE connected <- true")
-	c.statusChannel <- CConnected
-	log.Debugln("client connected <- true")
+	return nil
 }
 
-func (c *Client) clientReadDataFromConnectionToIncomingChannel() {
-	bLen := make([]byte, 4)
+// failedToConnect changes the status to CTimeout or CError (unless the client is closing)
+func (c *Client) failedToConnect(err error) {
+	if errors.Is(err, errConnectTimeout) {
+		c.state.transition(CTimeout, err)
+	} else {
+		c.state.transition(CError, err)
+	}
+}
+
+var (
+	errConnectTimeout = errors.New("client timed out trying to connect")
+	errClientClosed   = errors.New("client has been closed")
+)
+
+// dialAndHandshake connects to the server over the configured Transport (retrying until the server is up, Timeout or Close)
+func (c *Client) dialAndHandshake() error {
+	log := withSubsystem(c.log, SubsystemReconnect)
+	startTime := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	for {
-		res := c.readData(bLen)
-		if !res {
-			break
+		if c.conf.Timeout != 0 {
+			if time.Since(startTime) > c.conf.Timeout {
+				return errConnectTimeout
+			}
+		}
+
+		conn, err := c.conf.Transport.Dial(ctx, c.Name)
+		if err == nil {
+			c.connMutex.Lock()
+			if c.closed() {
+				c.connMutex.Unlock()
+				conn.Close()
+				return errClientClosed
+			}
+			c.conn = conn
+			c.connReader = newConnReader(conn)
+			c.connMutex.Unlock()
+
+			handshakeLog := withSubsystem(c.log.With("peer_pid", peerPID(conn)), SubsystemHandshake)
+			handshakeLog.Debug("connected to server, waiting for its handshake")
+			err = c.clientDoPassiveHandshake(handshakeLog)
+			c.conf.Metrics.Handshake(handshakeResultOf(err), err)
+			if err != nil {
+				conn.Close()
+			}
+			return err
+		} else if errors.Is(err, ErrDialPermanent) {
+			return err
+		}
+		log.Debug("could not dial server, retrying", "error", err, "retry_timer", c.conf.RetryTimer)
+
+		select {
+		case <-time.After(c.conf.RetryTimer):
+		case <-c.done:
+			return errClientClosed
+		}
+	}
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// clientReadDataFromConnectionToIncomingChannel reads the frames of one connection to the server.
+// Once the connection is gone, it stops the connection's writing goroutine and reconnects (unless the client is closing).
+func (c *Client) clientReadDataFromConnectionToIncomingChannel(conn net.Conn, reader *connReader, log *slog.Logger, connDone chan struct{}, writerDone chan struct{}) {
+	var connErr error
+	defer func() {
+		log.Debug("connection to server lost", "cause", connErr)
+		conn.Close()
+		reader.closeUnclaimedFiles()
+		close(connDone)
+		<-writerDone
+		err := c.state.transition(CReConnecting, connErr) // fails if the client is closing
+		if err == nil {
+			go c.reconnect()
+		}
+	}()
+
+	bLen := make([]byte, 4)
+	for {
+		connErr = c.readData(reader, bLen)
+		if connErr != nil {
+			return
 		}
 
 		mLen := bytesToInt(bLen)
 		msg := make([]byte, mLen)
-		res = c.readData(msg)
-		if !res {
-			break
+		connErr = c.readData(reader, msg)
+		if connErr != nil {
+			return
 		}
 
 		var err error
 		if c.conf.Encryption {
-			msg, err = decrypt(c.cipher, msg)
+			msg, err = c.crypto.open(msg)
 			if err != nil {
-				break
+				c.conf.Metrics.EncryptionError()
+				c.crypto.log.Warn("could not decrypt message from server", "error", err)
+				connErr = err
+				return
 			}
 		}
-		msgTypeInt := bytesToInt(msg[:4])
+		msgType := bytesToMsgType(msg[:4])
 		msgData := msg[4:]
-		if msgTypeInt < 0 {
-			// TODO some func to call for internal messages from the other side
+		var m *Message
+		if msgType == messageWithFiles {
+			m, err = receiveMessageWithFiles(reader, msgData)
+			if err != nil {
+				m = NewIpcErrorMessage(err)
+			}
+		} else if msgType == messageWithHeaders {
+			m, err = decodeMessageWithHeaders(msgData)
+			if err != nil {
+				m = NewIpcErrorMessage(err)
+			}
+		} else if msgType < 0 {
+			err = c.handleInternalMessage(msgType, msgData)
+			if errors.Is(err, errRekeyUnencrypted) {
+				log.Warn("dropping connection", "msg_type", msgType, "error", err)
+				c.deliver(NewIpcErrorMessage(err))
+				connErr = err
+				return
+			}
+			if err != nil {
+				log.Debug("error handling internal message", "msg_type", msgType, "error", err)
+				m = NewIpcErrorMessage(err)
+			}
 		} else {
-			c.incoming <- NewMessage(MsgType(msgTypeInt), msgData)
+			m = NewMessage(msgType, msgData)
+		}
+		reader.closeUnclaimedFiles()
+		if m != nil && m.Err == nil {
+			c.conf.Metrics.MessageReceived(m.MsgType, len(m.Data))
+		}
+		if m != nil && !c.deliver(m) {
+			return
 		}
-	}
-}
 
-func (c *Client) readData(buff []byte) bool {
-	_, err := io.ReadFull(c.conn, buff)
-	if err != nil {
-		if strings.Contains(err.Error(), "EOF") { // the connection has been closed by the client.
-			c.conn.Close()
-			if c.status != CClosing {
-				go c.reconnect()
+		if c.conf.Encryption && c.crypto.session.RekeyDue(c.crypto.afterFrames, c.crypto.afterDuration) {
+			// the writing goroutine might be idle while the server keeps sending
+			select {
+			case c.crypto.control <- c.maybeStartRekey:
+			default:
 			}
-
-			return false
 		}
+	}
+}
 
-		if c.status == CClosing {
-			c.status = CClosed
-			c.statusChannel <- CClosed
+// deliver hands a received message to Receive, false if the client has been closed meanwhile
+func (c *Client) deliver(m *Message) bool {
+	return !errors.Is(c.incoming.put(m, c.done), errQueueClosed)
+}
 
-			return false
-		}
+// handleInternalMessage reacts to internal messages (MsgType < 0) from the server
+func (c *Client) handleInternalMessage(msgType MsgType, data []byte) error {
+	err := c.crypto.rejectUnencryptedRekey(msgType)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case rekeyResponse:
+		return c.crypto.clientReceivedRekeyResponse(data)
+	case handlerFailure:
+		return &RemoteError{Message: string(data)}
+	default:
+		return errors.New(fmt.Sprintf("client received unknown internal message type %d", msgType))
+	}
+}
 
-		// other serverReadDataFromConnectionToIncomingChannel error
-		return false
+// maybeStartRekey initiates a session key rotation if the current key has been used for long enough (writing goroutine only)
+func (c *Client) maybeStartRekey(conn net.Conn) error {
+	if !c.conf.Encryption {
+		return nil
 	}
+	return c.crypto.clientMaybeStartRekey(conn)
+}
 
-	return true
+func (c *Client) readData(reader *connReader, buff []byte) error {
+	_, err := io.ReadFull(reader, buff)
+	return err
 }
 
 func (c *Client) reconnect() {
-	c.ClearConnectionStatus()
-	c.status = CReConnecting
-	c.statusChannel <- CReConnecting
-	err := c.clientDialAndHandshakeToServer() // connect to the pipe
+	err := c.dialAndHandshake() // connect to the pipe
 	if err != nil {
-		if err.Error() == "client timed out trying to connect" {
-			c.status = CTimeout
-			c.statusChannel <- CTimeout
-		} else {
-			c.status = CError
-			c.statusChannel <- CError
-		}
+		c.failedToConnect(err)
 		return
 	}
 
-	c.status = CConnected
-	c.statusChannel <- CConnected
+	err = c.state.transitionToNewSession(CConnected)
+	if err != nil {
+		return // closed meanwhile, Close closes the connection
+	}
+	c.conf.Metrics.Reconnect()
+	c.connMutex.Lock()
+	conn, reader := c.conn, c.connReader
+	c.connMutex.Unlock()
 
-	go c.clientReadDataFromConnectionToIncomingChannel()
+	c.processMessages(conn, reader)
 }
 
-// Receive - blocking function that receives messages
+// Receive - blocking function that receives messages (that passed the Inbound interceptors, see Use)
 // if MsgType is a negative number it's an internal message
 func (c *Client) Receive() (*Message, error) {
-	m, ok := <-c.incoming
-	if !ok {
-		return nil, errors.New("client the received channel has been closed")
-	}
+	for {
+		m, err := c.incoming.take(c.done)
+		if errors.Is(err, errQueueClosed) {
+			return nil, errClientClosed
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	if m.Err != nil {
-		close(c.incoming)
-		close(c.outgoing)
+		if m.Err != nil {
+			return nil, m.Err
+		}
 
-		return nil, m.Err
+		m, err = c.interceptors.receive(m)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			traceReceived(c.conf.Tracer, context.Background(), c.Name, m)
+			return m, nil
+		}
 	}
+}
 
-	return m, nil
+// Use - adds an Interceptor called with each message sent (Send, SendFDs) and received (Receive).
+// Interceptors are called in the order they were added.
+func (c *Client) Use(interceptor Interceptor) {
+	c.interceptors.use(interceptor)
 }
 
 // Send - writes a  message to the ipc connection.
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
+// If the outgoing queue is full Send waits, drops the message or returns ErrQueueFull, see ClientConfig.OutgoingOverflow
 func (c *Client) Send(msgType MsgType, message []byte) error {
+	return c.SendContext(context.Background(), msgType, message)
+}
+
+// SendContext - writes a message like Send, the span of ctx is the parent of the sending span (see ClientConfig.Tracer)
+func (c *Client) SendContext(ctx context.Context, msgType MsgType, message []byte) error {
 	if msgType <= 0 {
 		return errors.New(fmt.Sprintf("client Send: cannot because message type %d is reserved (0 or below)", msgType))
 	}
 
-	if c.status != CConnected {
-		return errors.New(fmt.Sprintf("client Send: cannot because client.status is: %s", c.status.String()))
+	status := c.state.get()
+	if status != CConnected {
+		return errors.New(fmt.Sprintf("client Send: cannot because client.status is: %s", status.String()))
 	}
 
 	msgLength := len(message)
@@ -214,67 +433,144 @@ func (c *Client) Send(msgType MsgType, message []byte) error {
 		return errors.New("client Send: cannot because message exceeds maximum message length")
 	}
 
-	c.outgoing <- NewMessage(msgType, message)
-
-	return nil
+	return c.send(ctx, NewMessage(msgType, message))
 }
 
-// clientWriteDataFromOutgoingChannelToConnection a message to Client.outgoing channel
-// eventually a message is structured as follows: lengthOfMsgTypePlusMessage + MsgType + Message
-func (c *Client) clientWriteDataFromOutgoingChannelToConnection() {
-	var err error
-	for {
-		msg, ok := <-c.outgoing
-		if !ok {
-			break
+// send passes msg through the Outbound interceptors, then enqueues it
+func (c *Client) send(ctx context.Context, msg *Message) error {
+	span := startSendSpan(c.conf.Tracer, ctx, c.Name, msg)
+	err := c.interceptors.run(Outbound, msg, func(msg *Message) error {
+		if msg.MsgType <= 0 {
+			closeFiles(msg.Files)
+			return errors.New(fmt.Sprintf("client Send: cannot because message type %d is reserved (0 or below)", msg.MsgType))
+		}
+		if len(msg.Data) > c.conf.MaxMsgSize {
+			closeFiles(msg.Files)
+			return errors.New("client Send: cannot because message exceeds maximum message length")
 		}
+		if err := validateHeaders(msg.Headers); err != nil {
+			closeFiles(msg.Files)
+			return err
+		}
+		return c.enqueue(msg)
+	})
+	span.End(err)
+	return err
+}
 
-		// eventually sending: MsgType + Message
-		toSend := msg.MsgType.toBytes()
-		toSend = append(toSend, msg.Data...)
+// enqueue hands a message to the writing goroutine, waiting while the client reconnects
+func (c *Client) enqueue(msg *Message) error {
+	msg.queuedAt = time.Now()
+	err := c.outgoing.put(msg, c.done)
+	if errors.Is(err, errQueueClosed) {
+		return errClientClosed
+	}
+	return err
+}
 
-		if c.conf.Encryption {
-			toSend, err = encrypt(c.cipher, toSend)
+// SendFDs - writes a message to the ipc connection and passes the files' descriptors alongside (SCM_RIGHTS).
+// Only supported on unix socket connections, returns ErrFDPassingNotSupported otherwise.
+// The files are duplicated, the caller may close them right after SendFDs returned.
+func (c *Client) SendFDs(msgType MsgType, message []byte, files ...*os.File) error {
+	if msgType <= 0 {
+		return errors.New(fmt.Sprintf("client SendFDs: cannot because message type %d is reserved (0 or below)", msgType))
+	}
+
+	status := c.state.get()
+	if status != CConnected {
+		return errors.New(fmt.Sprintf("client SendFDs: cannot because client.status is: %s", status.String()))
+	}
+
+	if len(message) > c.conf.MaxMsgSize {
+		return errors.New("client SendFDs: cannot because message exceeds maximum message length")
+	}
+
+	c.connMutex.Lock()
+	conn := c.conn
+	c.connMutex.Unlock()
+	msg, err := newFilesMessage(conn, msgType, message, files)
+	if err != nil {
+		return err
+	}
+	return c.send(context.Background(), msg)
+}
+
+// clientWriteDataFromOutgoingChannelToConnection writes messages of Client.outgoing to one connection until the reading goroutine noticed it's gone
+// eventually a message is structured as follows: lengthOfMsgTypePlusMessage + MsgType + Message
+func (c *Client) clientWriteDataFromOutgoingChannelToConnection(conn net.Conn, log *slog.Logger, connDone <-chan struct{}, writerDone chan<- struct{}) {
+	defer close(writerDone)
+	for {
+		select {
+		case <-connDone:
+			return
+		case <-c.done:
+			return
+		case writeControlFrame := <-c.crypto.control:
+			err := writeControlFrame(conn)
+			if err != nil {
+				log.Debug("error writing internal message", "error", err)
+			}
+		case msg := <-c.outgoing.messages:
+			c.outgoing.taken()
+			// eventually sending: MsgType + Message
+			err := c.crypto.writeMessage(conn, msg)
 			if err != nil {
-				log.Debugln("client error encrypting data", err)
+				log.Debug("error writing data", "msg_type", msg.MsgType, "error", err)
 				continue
 			}
+			c.messageWritten(msg)
+			err = c.maybeStartRekey(conn)
+			if err != nil {
+				log.Debug("error starting rekey", "error", err)
+			}
 		}
+	}
+}
 
-		writer := bufio.NewWriter(c.conn)
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
-		err = writer.Flush()
-		if err != nil {
-			log.Debugln("client error flushing data", err)
-			continue
-		}
+// messageWritten reports a message written to the connection to the Metrics
+func (c *Client) messageWritten(msg *Message) {
+	if msg.MsgType > 0 {
+		c.conf.Metrics.MessageSent(msg.MsgType, len(msg.Data))
+		c.conf.Metrics.SendLatency(time.Since(msg.queuedAt))
 	}
 }
 
 // Status StatusCode - returns the current connection status
 func (c *Client) Status() ClientStatus {
-	return c.status
+	return c.state.get()
+}
+
+// QueueStats - returns the current depth, high-water mark and drops of the incoming and outgoing queues
+func (c *Client) QueueStats() QueueStats {
+	return QueueStats{Incoming: c.incoming.stat(), Outgoing: c.outgoing.stat()}
+}
+
+// LogLevels - the levels of the client's logs, changing them takes effect immediately
+func (c *Client) LogLevels() *LogLevels {
+	return c.conf.LogLevels
 }
 
-// Close - closes the connection
+// Close - closes the connection, pending Receive and Send calls return an error
 func (c *Client) Close() {
-	c.status = CClosing
-	c.statusChannel <- CClosing
+	err := c.state.transition(CClosing, nil)
+	if err != nil {
+		return // already closing
+	}
+	close(c.done)
+
+	c.connMutex.Lock()
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	c.connMutex.Unlock()
+
+	c.state.transition(CClosed, nil)
 }
 
+// ClearConnectionStatus - does nothing anymore.
+//
+// Deprecated: status changes are queued without blocking, there is nothing to clear.
 func (c *Client) ClearConnectionStatus() {
-	select {
-	case <-c.statusChannel:
-		// silently emptying "connected" channel (if there is something in it)
-	default:
-		// there wasn't anything in it anyway
-	}
-	c.status = CNotConnected
-	c.statusChannel <- CNotConnected
 }
 
 func createClient(ipcName string, config *ClientConfig) (*Client, error) {
@@ -284,11 +580,9 @@ func createClient(ipcName string, config *ClientConfig) (*Client, error) {
 	}
 
 	c := &Client{
-		Name:          ipcName,
-		status:        CNotConnected,
-		statusChannel: make(chan ClientStatus),
-		incoming:      make(chan *Message),
-		outgoing:      make(chan *Message),
+		Name:   ipcName,
+		done:   make(chan struct{}),
+		crypto: newKeyRotation(),
 	}
 
 	if config == nil {
@@ -297,6 +591,18 @@ func createClient(ipcName string, config *ClientConfig) (*Client, error) {
 		c.conf = *config
 	}
 
+	if c.conf.LogLevels == nil {
+		c.conf.LogLevels = LogLevelsFromEnv()
+	}
+	if c.conf.Logger == nil {
+		c.conf.Logger = slog.Default()
+		c.log = newDefaultLogger(c.conf.LogLevels)
+	} else {
+		c.log = newLogger(c.conf.Logger, c.conf.LogLevels)
+	}
+	c.log = c.log.With("ipc", ipcName, "role", "client")
+	c.state = newStatusMachine("client", CNotConnected, clientTransitions, c.log)
+
 	if c.conf.Timeout < 0 {
 		c.conf.Timeout = DefaultClientConfig.Timeout
 	}
@@ -306,5 +612,41 @@ func createClient(ipcName string, config *ClientConfig) (*Client, error) {
 	if c.conf.SocketBasePath == "" {
 		c.conf.SocketBasePath = DefaultClientConfig.SocketBasePath
 	}
+	if c.conf.Transport == nil {
+		c.conf.Transport = newDefaultTransport(ServerConfig{SocketBasePath: c.conf.SocketBasePath, AbstractSocket: c.conf.AbstractSocket})
+	}
+	if len(c.conf.CipherSuites) == 0 {
+		c.conf.CipherSuites = DefaultClientConfig.CipherSuites
+	}
+	if c.conf.HandshakeTimeout <= 0 {
+		c.conf.HandshakeTimeout = DefaultClientConfig.HandshakeTimeout
+	}
+	if c.conf.RekeyAfterFrames == 0 {
+		c.conf.RekeyAfterFrames = DefaultClientConfig.RekeyAfterFrames
+	}
+	if c.conf.RekeyAfterDuration <= 0 {
+		c.conf.RekeyAfterDuration = DefaultClientConfig.RekeyAfterDuration
+	}
+	if c.conf.IncomingQueueSize < 0 {
+		c.conf.IncomingQueueSize = DefaultClientConfig.IncomingQueueSize
+	}
+	if c.conf.OutgoingQueueSize < 0 {
+		c.conf.OutgoingQueueSize = DefaultClientConfig.OutgoingQueueSize
+	}
+	if c.conf.Metrics == nil {
+		c.conf.Metrics = noMetrics{}
+	}
+	if c.conf.Tracer == nil {
+		c.conf.Tracer = noTracer{}
+	}
+	err = checkQueueConfig(Inbound, c.conf.IncomingQueueSize, c.conf.IncomingOverflow)
+	if err == nil {
+		err = checkQueueConfig(Outbound, c.conf.OutgoingQueueSize, c.conf.OutgoingOverflow)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.incoming = newMessageQueue(Inbound, c.conf.IncomingQueueSize, c.conf.IncomingOverflow, c.conf.Metrics, c.log)
+	c.outgoing = newMessageQueue(Outbound, c.conf.OutgoingQueueSize, c.conf.OutgoingOverflow, c.conf.Metrics, c.log)
 	return c, nil
 }
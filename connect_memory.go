@@ -0,0 +1,102 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// MemoryTransport - connects client and server within the same process over net.Pipe, without creating any sockets.
+// Handshake, framing and encryption run exactly like over a socket, so applications can test their ipc code hermetically.
+// Client and server have to use the same MemoryTransport, different MemoryTransports don't see each other's ipc names
+// (so tests using their own MemoryTransport can run in parallel).
+type MemoryTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Listen(name string) (net.Listener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.listeners == nil {
+		t.listeners = make(map[string]*memoryListener)
+	}
+	if _, ok := t.listeners[name]; ok {
+		return nil, errors.New("memory transport: already listening on " + name)
+	}
+
+	l := &memoryListener{
+		transport: t,
+		addr:      memoryAddr(name),
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[name] = l
+	return l, nil
+}
+
+// Dial connects to the listener of the given name, the client retries (until its Timeout) while there is none
+func (t *MemoryTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	t.mutex.Lock()
+	l, ok := t.listeners[name]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("memory transport: nobody listening on " + name)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.closed:
+		return nil, errors.New("memory transport: listener closed " + name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.transport.mutex.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
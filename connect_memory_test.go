@@ -0,0 +1,76 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransportRoundTrip(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		transport := NewMemoryTransport()
+		s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: encryption})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: encryption})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Send(Custom, []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := s.Receive()
+		if err != nil || string(m.Data) != "ping" || m.MsgType != Custom {
+			t.Fatalf("encryption %v: server received %v, %v", encryption, m, err)
+		}
+		err = s.Send(Custom+1, []byte("pong"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err = c.Receive()
+		if err != nil || string(m.Data) != "pong" || m.MsgType != Custom+1 {
+			t.Fatalf("encryption %v: client received %v, %v", encryption, m, err)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestMemoryTransportsAreSeparate(t *testing.T) {
+	transport, other := NewMemoryTransport(), NewMemoryTransport()
+	l, err := transport.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.Listen("test"); err == nil {
+		t.Error("listened twice on the same name")
+	}
+	if _, err := other.Dial(context.Background(), "test"); err == nil {
+		t.Error("dialed the listener of another MemoryTransport")
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("accepted on a closed listener")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := transport.Dial(ctx, "test"); err == nil {
+		t.Error("dialed a closed listener")
+	}
+	if _, err := transport.Listen("test"); err != nil {
+		t.Errorf("listening again after Close: %v", err)
+	}
+}
+
+func TestDialTimeoutIsReturned(t *testing.T) {
+	_, err := ClientDialAndHandshake("nobody-listening", &ClientConfig{Transport: NewMemoryTransport(), Timeout: 20 * time.Millisecond, RetryTimer: time.Millisecond})
+	if !errors.Is(err, errConnectTimeout) {
+		t.Errorf("dialing without a server returned %v, expected %v", err, errConnectTimeout)
+	}
+}
@@ -4,76 +4,97 @@
 package ipc
 
 import (
+	"context"
 	"errors"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
-	"syscall"
-	"time"
+	"runtime"
 )
 
-var defaultSocketBasePath = "/tmp/"
+// defaultSocketBasePath - $XDG_RUNTIME_DIR, or a private per-user directory in the system's temp directory
+var defaultSocketBasePath = userRuntimeDir()
 var defaultSocketExt = ".sock"
 
-// serverRun create a unix socket and start listening connections - for unix and linux
-func (s *Server) serverRun() error {
-	socketPath := filepath.Join(s.conf.SocketBasePath, s.Name+defaultSocketExt)
+// abstractSocketPrefix - abstract socket names don't depend on SocketBasePath, which defaults to a per-user directory
+const abstractSocketPrefix = "golang-ipc/"
 
-	if err := os.RemoveAll(socketPath); err != nil {
-		return err
-	}
+// UnixSocketTransport - connects client and server over the unix socket SocketBasePath/<ipc name>.sock - for unix and linux
+//
+// With Abstract (linux only) the socket lives in the abstract namespace as @golang-ipc/<ipc name>.sock instead,
+// no socket file is ever created or removed. SocketBasePath doesn't apply, so processes of all users find the same socket. Abstract sockets have no file permissions: every process in the same
+// network namespace (e.g. the host and all containers started with --network=host) can connect, no matter which user
+// it runs as, while processes in other network namespaces (e.g. containers with their own network) can't.
+//
+// A socket file is only replaced if no server is listening on it anymore: Listen takes an exclusive lock on
+// <socket>.lock (kept next to the socket) and refuses to start if another server holds it or still answers on the socket.
+// The socket file is removed when the listener gets closed.
+type UnixSocketTransport struct {
+	SocketBasePath string
+	Abstract       bool        // use the linux abstract socket namespace instead of a socket file
+	SocketFileMode os.FileMode // permissions of the socket file, e.g. 0660 (0: as created with the process' umask)
+	SocketOwner    string      // user name or uid to chown the socket file to ("": unchanged)
+	SocketGroup    string      // group name or gid to chown the socket file to ("": unchanged)
 
-	if s.conf.UnmaskPermissions {
-		defer syscall.Umask(syscall.Umask(0))
-	}
+	// Deprecated: use SocketFileMode 0666 instead. Makes the socket writable for any user if SocketFileMode is not set.
+	UnmaskPermissions bool
+}
 
-	listen, err := net.Listen("unix", socketPath)
-	if err != nil {
-		return err
+func newDefaultTransport(conf ServerConfig) Transport {
+	return &UnixSocketTransport{
+		SocketBasePath:    conf.SocketBasePath,
+		Abstract:          conf.AbstractSocket,
+		SocketFileMode:    conf.SocketFileMode,
+		SocketOwner:       conf.SocketOwner,
+		SocketGroup:       conf.SocketGroup,
+		UnmaskPermissions: conf.UnmaskPermissions,
 	}
+}
 
-	s.listen = listen
-	s.status = SListening
-	s.statusChannel <- SListening
+func (t *UnixSocketTransport) socketPath(name string) string {
+	if t.Abstract {
+		return "@" + abstractSocketPrefix + name + defaultSocketExt // a leading @ makes the net package use the abstract namespace
+	}
+	return filepath.Join(t.SocketBasePath, name+defaultSocketExt)
+}
 
-	log.Debugln("server ok connected to socket ...waiting for clients to connect...")
-	return nil
+func userRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		return dir + "/"
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("golang-ipc-%d", os.Getuid())) + "/"
 }
 
-// clientDialAndHandshakeToServer connect to the unix socket created by the server -  for unix and linux
-func (c *Client) clientDialAndHandshakeToServer() error {
-	socketPath := filepath.Join(c.conf.SocketBasePath, c.Name+defaultSocketExt)
-	startTime := time.Now()
+// Listen creates the unix socket and starts listening for connections
+func (t *UnixSocketTransport) Listen(name string) (net.Listener, error) {
+	socketPath := t.socketPath(name)
 
-	for {
-		if c.conf.Timeout != 0 {
-			if time.Since(startTime) > c.conf.Timeout {
-				c.status = CClosed
-				c.statusChannel <- CClosed
-				return errors.New("client timed out trying to connect")
-			}
+	if t.Abstract {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("abstract unix sockets are only supported on linux")
 		}
+		return net.Listen("unix", socketPath)
+	}
 
-		socketConnection, err := net.Dial("unix", socketPath)
-		if err != nil {
-			if strings.Contains(err.Error(), "no such file or directory") {
-				// waiting for the server to come up
-			} else if strings.Contains(err.Error(), "connection refused") {
-			}
-		} else {
-			c.conn = socketConnection
-
-			log.Debugln("client connected to server socket ... now waiting for server handshake")
-			err = c.clientDoPassiveHandshake()
-			if err != nil {
-				return err
-			}
+	err := prepareSocketDir(t.SocketBasePath, filepath.Dir(socketPath))
+	if err != nil {
+		return nil, err
+	}
 
-			return nil
-		}
+	mode := t.SocketFileMode
+	if mode == 0 && t.UnmaskPermissions {
+		mode = 0777
+	}
+	return listenSocketFile(socketPath, mode, t.SocketOwner, t.SocketGroup)
+}
 
-		time.Sleep(c.conf.RetryTimer * time.Second)
+// Dial connects to the unix socket created by the server
+func (t *UnixSocketTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if t.Abstract && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("%w: abstract unix sockets are only supported on linux", ErrDialPermanent)
 	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", t.socketPath(name))
 }
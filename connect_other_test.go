@@ -0,0 +1,114 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are linux only")
+	}
+	name := fmt.Sprintf("abstract-test-%d", os.Getpid())
+	s, err := StartServer(name, &ServerConfig{AbstractSocket: true, SocketBasePath: t.TempDir() + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if addr := s.listen.Addr().String(); addr != "@golang-ipc/"+name+".sock" {
+		t.Errorf("listening on %s", addr)
+	}
+
+	// the socket name doesn't depend on SocketBasePath (the per-user runtime directory by default)
+	c, err := ClientDialAndHandshake(name, &ClientConfig{AbstractSocket: true, SocketBasePath: t.TempDir() + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mustExchange(t, 10, c.Send, s.Receive)
+	mustExchange(t, 10, s.Send, c.Receive)
+}
+
+func TestUserRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if dir := userRuntimeDir(); dir != "/run/user/1000/" {
+		t.Errorf("runtime dir %s with XDG_RUNTIME_DIR set", dir)
+	}
+	expected := filepath.Join(os.TempDir(), fmt.Sprintf("golang-ipc-%d", os.Getuid())) + "/"
+	for _, env := range []string{"", "relative/dir"} {
+		t.Setenv("XDG_RUNTIME_DIR", env)
+		if dir := userRuntimeDir(); dir != expected {
+			t.Errorf("runtime dir %s with XDG_RUNTIME_DIR=%q, expected %s", dir, env, expected)
+		}
+	}
+}
+
+// withDefaultSocketBasePath makes basePath the default socket base path for the test
+func withDefaultSocketBasePath(t *testing.T, basePath string) {
+	t.Helper()
+	previous := defaultSocketBasePath
+	defaultSocketBasePath = basePath
+	t.Cleanup(func() { defaultSocketBasePath = previous })
+}
+
+func TestPrepareSocketDirCreatesMissingDir(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "runtime") + "/"
+	withDefaultSocketBasePath(t, basePath)
+	socketDir := filepath.Join(basePath, "sub")
+	if err := prepareSocketDir(basePath, socketDir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("created the base path with mode %s, expected 0700", info.Mode().Perm())
+	}
+	if _, err := os.Stat(socketDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrepareSocketDirRejectsWorldWritableDir(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "runtime") + "/"
+	withDefaultSocketBasePath(t, basePath)
+	if err := os.Mkdir(basePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(basePath, 0777); err != nil { // not subject to the umask
+		t.Fatal(err)
+	}
+	if err := prepareSocketDir(basePath, basePath); err == nil {
+		t.Error("accepted a world-writable default base path")
+	}
+
+	// a base path other than the default one is the user's choice
+	withDefaultSocketBasePath(t, t.TempDir()+"/")
+	if err := prepareSocketDir(basePath, basePath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrepareSocketDirRejectsDirOfOtherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of a directory needs root")
+	}
+	basePath := filepath.Join(t.TempDir(), "runtime") + "/"
+	withDefaultSocketBasePath(t, basePath)
+	if err := os.Mkdir(basePath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(basePath, 65534, 65534); err != nil { // nobody
+		t.Fatal(err)
+	}
+	if err := prepareSocketDir(basePath, basePath); err == nil {
+		t.Error("accepted a default base path owned by another user")
+	}
+}
@@ -0,0 +1,548 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const defaultShmRingSize = 4 << 20 // 4MiB per direction
+
+// shmSetupTimeout - passing the shared memory to a connecting client must not block the listener's Accept for longer
+const shmSetupTimeout = time.Second
+
+var errShmRingCorrupt = errors.New("shm transport: ring buffer indices out of bounds")
+
+// ShmTransport - connects client and server on the same host over two ring buffers in shared memory (linux only).
+//
+// The server creates a memfd holding one ring buffer per direction and passes it to the client over the unix socket
+// of the embedded UnixSocketTransport. Afterward, all data (including the ipc handshake) goes through the ring buffers,
+// the unix socket is only used to wake up the other side while it waits for data or free space.
+// This saves the copying through the kernel for high-throughput links, the Client/Server API stays the same
+// (except SendFDs, which is not supported).
+type ShmTransport struct {
+	UnixSocketTransport
+	RingSize int // bytes per direction, a power of two (default 4MiB)
+}
+
+// ring buffer header, producer and consumer fields on separate cache lines
+const (
+	shmHeadOffset            = 0  // uint64: bytes consumed so far
+	shmConsumerWaitingOffset = 8  // uint32: 1 if the consumer waits for data
+	shmTailOffset            = 64 // uint64: bytes produced so far
+	shmProducerWaitingOffset = 72 // uint32: 1 if the producer waits for free space
+	shmHeaderSize            = 128
+)
+
+// wakeups sent over the unix socket
+const (
+	shmWakeupData  byte = 'd' // there is new data in your receiving ring buffer
+	shmWakeupSpace byte = 's' // there is free space in your sending ring buffer
+)
+
+func (t *ShmTransport) ringSize() (int, error) {
+	size := t.RingSize
+	if size == 0 {
+		size = defaultShmRingSize
+	}
+	if size < 4096 || size&(size-1) != 0 {
+		return 0, errors.New(fmt.Sprintf("shm transport: ring size %d is not a power of two >= 4096", size))
+	}
+	return size, nil
+}
+
+func (t *ShmTransport) unixTransport() *UnixSocketTransport {
+	unixTransport := t.UnixSocketTransport
+	if unixTransport.SocketBasePath == "" {
+		unixTransport.SocketBasePath = defaultSocketBasePath
+	}
+	return &unixTransport
+}
+
+func (t *ShmTransport) Listen(name string) (net.Listener, error) {
+	ringSize, err := t.ringSize()
+	if err != nil {
+		return nil, err
+	}
+	listen, err := t.unixTransport().Listen(name)
+	if err != nil {
+		return nil, err
+	}
+	return &shmListener{Listener: listen, ringSize: ringSize}, nil
+}
+
+// Dial connects to the server's unix socket and maps the shared memory the server passes
+func (t *ShmTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	conn, err := t.unixTransport().Dial(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	sock, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("shm transport: expected a unix socket connection, got %T", conn))
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		sock.SetReadDeadline(deadline)
+	}
+	setup := make([]byte, 8)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := sock.ReadMsgUnix(setup, oob)
+	if err == nil && (n != len(setup) || oobn == 0) {
+		err = errors.New("shm transport: invalid setup message from server")
+	}
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	sock.SetReadDeadline(time.Time{})
+
+	fd, err := parseSingleUnixRight(oob[:oobn])
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	defer syscall.Close(fd) // the mapping keeps the memory
+
+	ringSize := int(binary.BigEndian.Uint64(setup))
+	if ringSize < 4096 || ringSize&(ringSize-1) != 0 {
+		sock.Close()
+		return nil, errors.New(fmt.Sprintf("shm transport: invalid ring size %d from server", ringSize))
+	}
+	mem, err := unix.Mmap(fd, 0, 2*(shmHeaderSize+ringSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	// the server sends in the first ring buffer and receives in the second one
+	return newShmConn(sock, mem, ringSize, false), nil
+}
+
+type shmListener struct {
+	net.Listener
+	ringSize int
+}
+
+// Accept creates the shared memory for a connecting client and passes it to the client
+func (l *shmListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		sock, ok := conn.(*net.UnixConn)
+		if !ok {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("shm transport: expected a unix socket connection, got %T", conn))
+		}
+		shmConn, err := l.setup(sock)
+		if err != nil {
+			conn.Close()
+			continue // the client is gone or doesn't read, keep listening
+		}
+		return shmConn, nil
+	}
+}
+
+func (l *shmListener) setup(sock *net.UnixConn) (*shmConn, error) {
+	fd, err := unix.MemfdCreate("golang-ipc-shm", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd) // the mapping keeps the memory
+
+	size := 2 * (shmHeaderSize + l.ringSize)
+	err = unix.Ftruncate(fd, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	mem, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := make([]byte, 8)
+	binary.BigEndian.PutUint64(setup, uint64(l.ringSize))
+	sock.SetWriteDeadline(time.Now().Add(shmSetupTimeout))
+	_, _, err = sock.WriteMsgUnix(setup, syscall.UnixRights(fd), nil)
+	if err != nil {
+		unix.Munmap(mem)
+		return nil, err
+	}
+	sock.SetWriteDeadline(time.Time{})
+
+	return newShmConn(sock, mem, l.ringSize, true), nil
+}
+
+func parseSingleUnixRight(oob []byte) (int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1, err
+	}
+	if len(msgs) != 1 {
+		return -1, errors.New("shm transport: expected exactly one control message")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return -1, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return -1, errors.New("shm transport: expected exactly one file descriptor")
+	}
+	return fds[0], nil
+}
+
+// shmRing - a single producer/single consumer ring buffer in shared memory
+type shmRing struct {
+	head            *uint64
+	tail            *uint64
+	consumerWaiting *uint32
+	producerWaiting *uint32
+	data            []byte
+	mask            uint64
+}
+
+func newShmRing(mem []byte, ringSize int) *shmRing {
+	return &shmRing{
+		head:            (*uint64)(unsafe.Pointer(&mem[shmHeadOffset])),
+		tail:            (*uint64)(unsafe.Pointer(&mem[shmTailOffset])),
+		consumerWaiting: (*uint32)(unsafe.Pointer(&mem[shmConsumerWaitingOffset])),
+		producerWaiting: (*uint32)(unsafe.Pointer(&mem[shmProducerWaitingOffset])),
+		data:            mem[shmHeaderSize : shmHeaderSize+ringSize],
+		mask:            uint64(ringSize - 1),
+	}
+}
+
+// read copies available data into p (consumer only), the indices come from the peer and are checked before use
+func (r *shmRing) read(p []byte) (int, error) {
+	head := atomic.LoadUint64(r.head)
+	available := atomic.LoadUint64(r.tail) - head
+	if available > uint64(len(r.data)) {
+		return 0, errShmRingCorrupt
+	}
+	n := min(uint64(len(p)), available)
+	if n == 0 {
+		return 0, nil
+	}
+
+	start := head & r.mask
+	copied := copy(p[:n], r.data[start:])
+	copy(p[copied:n], r.data)
+	atomic.StoreUint64(r.head, head+n)
+	return int(n), nil
+}
+
+// write copies as much of p as fits into the ring buffer (producer only), the indices come from the peer and are checked before use
+func (r *shmRing) write(p []byte) (int, error) {
+	tail := atomic.LoadUint64(r.tail)
+	used := tail - atomic.LoadUint64(r.head)
+	if used > uint64(len(r.data)) {
+		return 0, errShmRingCorrupt
+	}
+	n := min(uint64(len(p)), uint64(len(r.data))-used)
+	if n == 0 {
+		return 0, nil
+	}
+
+	start := tail & r.mask
+	copied := copy(r.data[start:], p[:n])
+	copy(r.data, p[copied:n])
+	atomic.StoreUint64(r.tail, tail+n)
+	return int(n), nil
+}
+
+func (r *shmRing) empty() bool {
+	return atomic.LoadUint64(r.tail) == atomic.LoadUint64(r.head)
+}
+
+func (r *shmRing) full() bool {
+	return atomic.LoadUint64(r.tail)-atomic.LoadUint64(r.head) == uint64(len(r.data))
+}
+
+// shmConn - a net.Conn over two shared memory ring buffers, the unix socket carries the wakeups
+type shmConn struct {
+	sock       *net.UnixConn
+	mem        []byte
+	send       *shmRing
+	recv       *shmRing
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+
+	dataReady  chan struct{} // peer wrote into recv
+	spaceReady chan struct{} // peer read from send
+	peerGone   chan struct{} // unix socket closed by the peer
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	readDeadline  shmDeadline
+	writeDeadline shmDeadline
+}
+
+func newShmConn(sock *net.UnixConn, mem []byte, ringSize int, server bool) *shmConn {
+	first := newShmRing(mem[:shmHeaderSize+ringSize], ringSize)
+	second := newShmRing(mem[shmHeaderSize+ringSize:], ringSize)
+	c := &shmConn{
+		sock:          sock,
+		mem:           mem,
+		send:          first,
+		recv:          second,
+		dataReady:     make(chan struct{}, 1),
+		spaceReady:    make(chan struct{}, 1),
+		peerGone:      make(chan struct{}),
+		closed:        make(chan struct{}),
+		readDeadline:  newShmDeadline(),
+		writeDeadline: newShmDeadline(),
+	}
+	if !server {
+		c.send, c.recv = second, first
+	}
+	go c.receiveWakeups()
+	return c
+}
+
+func (c *shmConn) receiveWakeups() {
+	defer close(c.peerGone)
+	buff := make([]byte, 64)
+	for {
+		n, err := c.sock.Read(buff)
+		for _, b := range buff[:n] {
+			switch b {
+			case shmWakeupData:
+				signal(c.dataReady)
+			case shmWakeupSpace:
+				signal(c.spaceReady)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *shmConn) wakeup(b byte) {
+	c.sock.Write([]byte{b})
+}
+
+// Read tears down the connection if the peer corrupted the ring buffer
+func (c *shmConn) Read(p []byte) (int, error) {
+	n, err := c.read(p)
+	if errors.Is(err, errShmRingCorrupt) {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *shmConn) read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for {
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		n, err := c.recv.read(p)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 || len(p) == 0 {
+			if atomic.SwapUint32(c.recv.producerWaiting, 0) == 1 {
+				c.wakeup(shmWakeupSpace)
+			}
+			return n, nil
+		}
+
+		// announce waiting before checking again, so the producer can't miss it
+		atomic.StoreUint32(c.recv.consumerWaiting, 1)
+		if !c.recv.empty() {
+			atomic.StoreUint32(c.recv.consumerWaiting, 0)
+			continue
+		}
+
+		select {
+		case <-c.dataReady:
+		case <-c.peerGone:
+			if c.recv.empty() {
+				return 0, io.EOF
+			}
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			atomic.StoreUint32(c.recv.consumerWaiting, 0)
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write tears down the connection if the peer corrupted the ring buffer
+func (c *shmConn) Write(p []byte) (int, error) {
+	n, err := c.write(p)
+	if errors.Is(err, errShmRingCorrupt) {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *shmConn) write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for {
+		select {
+		case <-c.closed:
+			return written, net.ErrClosed
+		case <-c.peerGone:
+			return written, syscall.EPIPE
+		default:
+		}
+
+		n, err := c.send.write(p[written:])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		if atomic.SwapUint32(c.send.consumerWaiting, 0) == 1 {
+			c.wakeup(shmWakeupData)
+		}
+		if written == len(p) {
+			return written, nil
+		}
+
+		// announce waiting before checking again, so the consumer can't miss it
+		atomic.StoreUint32(c.send.producerWaiting, 1)
+		if !c.send.full() {
+			atomic.StoreUint32(c.send.producerWaiting, 0)
+			continue
+		}
+
+		select {
+		case <-c.spaceReady:
+		case <-c.peerGone:
+		case <-c.closed:
+		case <-c.writeDeadline.wait():
+			atomic.StoreUint32(c.send.producerWaiting, 0)
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *shmConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.sock.Close()
+
+		// wait for pending reads/writes to notice the close before unmapping the memory
+		c.readMutex.Lock()
+		c.writeMutex.Lock()
+		unix.Munmap(c.mem)
+		c.writeMutex.Unlock()
+		c.readMutex.Unlock()
+	})
+	return err
+}
+
+func (c *shmConn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+func (c *shmConn) RemoteAddr() net.Addr {
+	return c.sock.RemoteAddr()
+}
+
+func (c *shmConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *shmConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *shmConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// shmDeadline - a channel that gets closed when the deadline is exceeded
+type shmDeadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newShmDeadline() shmDeadline {
+	return shmDeadline{cancel: make(chan struct{})}
+}
+
+func (d *shmDeadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired, wait until it closed cancel
+	}
+	d.timer = nil
+
+	exceeded := false
+	select {
+	case <-d.cancel:
+		exceeded = true
+	default:
+	}
+
+	if t.IsZero() {
+		if exceeded {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if duration := time.Until(t); duration > 0 {
+		if exceeded {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(duration, func() { close(cancel) })
+		return
+	}
+	if !exceeded {
+		close(d.cancel)
+	}
+}
+
+func (d *shmDeadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
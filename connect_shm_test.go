@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// newTestShmRing returns a ring buffer in ordinary (8 byte aligned) memory
+func newTestShmRing(ringSize int) *shmRing {
+	mem := make([]uint64, (shmHeaderSize+ringSize)/8)
+	return newShmRing(unsafe.Slice((*byte)(unsafe.Pointer(&mem[0])), shmHeaderSize+ringSize), ringSize)
+}
+
+func TestShmRingWrapAround(t *testing.T) {
+	r := newTestShmRing(4096)
+	for i := 0; i < 5; i++ { // 3000 bytes per round wrap around from the second round on
+		data := bytes.Repeat([]byte{byte(i)}, 3000)
+		if n, err := r.write(data); n != len(data) || err != nil {
+			t.Fatalf("round %d: wrote %d, %v", i, n, err)
+		}
+		read := make([]byte, 4096)
+		n, err := r.read(read)
+		if err != nil || !bytes.Equal(read[:n], data) {
+			t.Fatalf("round %d: read %d bytes, %v", i, n, err)
+		}
+		if !r.empty() {
+			t.Fatalf("round %d: ring not empty after reading everything", i)
+		}
+	}
+}
+
+func TestShmRingFull(t *testing.T) {
+	r := newTestShmRing(4096)
+	if n, err := r.write(make([]byte, 5000)); n != 4096 || err != nil {
+		t.Fatalf("wrote %d, %v into an empty ring of 4096 bytes", n, err)
+	}
+	if !r.full() {
+		t.Fatal("ring not full")
+	}
+	if n, err := r.write([]byte{1}); n != 0 || err != nil {
+		t.Fatalf("wrote %d, %v into a full ring", n, err)
+	}
+	if n, err := r.read(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	if n, err := r.write(make([]byte, 5000)); n != 100 || err != nil {
+		t.Fatalf("wrote %d, %v after reading 100 bytes", n, err)
+	}
+}
+
+func TestShmRingCorruptIndices(t *testing.T) {
+	r := newTestShmRing(4096)
+	*r.tail = *r.head + 2*4096 // as a misbehaving peer could
+	if _, err := r.read(make([]byte, 100)); !errors.Is(err, errShmRingCorrupt) {
+		t.Errorf("read returned %v from a corrupt ring", err)
+	}
+	if _, err := r.write(make([]byte, 100)); !errors.Is(err, errShmRingCorrupt) {
+		t.Errorf("write returned %v into a corrupt ring", err)
+	}
+}
+
+// newShmTransport returns a ShmTransport with its socket in a temporary directory
+func newShmTransport(t *testing.T, ringSize int) *ShmTransport {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ipc") // t.TempDir() may exceed the maximum unix socket path length
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &ShmTransport{UnixSocketTransport: UnixSocketTransport{SocketBasePath: dir + "/"}, RingSize: ringSize}
+}
+
+func TestShmConnClosedPeer(t *testing.T) {
+	transport := newShmTransport(t, 4096)
+	listen, err := transport.Listen("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		server, err := listen.Accept()
+		if err == nil {
+			_, err = server.Write([]byte("bye"))
+			server.Close()
+		}
+		accepted <- err
+	}()
+	client, err := transport.Dial(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	// data written before the close is still delivered
+	data, err := io.ReadAll(client)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write(make([]byte, 3*4096)) // doesn't fit into the ring, nobody reads
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("write to a closed peer succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a closed peer blocks")
+	}
+}
+
+func TestShmTransport(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		transport := newShmTransport(t, 4096)
+		s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: encryption})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: encryption, Timeout: 5 * time.Second})
+		if err != nil {
+			s.Close()
+			t.Fatalf("encryption %v: %v", encryption, err)
+		}
+		mustExchange(t, 100, c.Send, s.Receive)
+		mustExchange(t, 100, s.Send, c.Receive)
+
+		// messages larger than the ring buffer
+		large := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+		if err := c.Send(Custom, large); err != nil {
+			t.Fatal(err)
+		}
+		m, err := s.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.Data, large) {
+			t.Errorf("encryption %v: received %d bytes, expected %d", encryption, len(m.Data), len(large))
+		}
+		c.Close()
+		s.Close()
+	}
+}
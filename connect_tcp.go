@@ -0,0 +1,37 @@
+package ipc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TCPTransport - connects client and server over tcp, the ipc name is the address to listen on/dial to (e.g. "127.0.0.1:7000").
+// With a TLSConfig the connection is secured with TLS (for mTLS set ClientAuth and ClientCAs on the server's, Certificates on the client's TLSConfig).
+type TCPTransport struct {
+	TLSConfig *tls.Config
+}
+
+func (t *TCPTransport) Listen(name string) (net.Listener, error) {
+	if t.TLSConfig != nil {
+		return tls.Listen("tcp", name, t.TLSConfig)
+	}
+	return net.Listen("tcp", name)
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	if t.TLSConfig == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", name)
+	}
+
+	dialer := tls.Dialer{Config: t.TLSConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", name)
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return nil, fmt.Errorf("%w: %w", ErrDialPermanent, err) // retrying won't help
+	}
+	return conn, err
+}
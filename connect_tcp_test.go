@@ -0,0 +1,91 @@
+package ipc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCertificate returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "golang-ipc test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCPTransportTLS(t *testing.T) {
+	cert, pool := selfSignedCertificate(t)
+	serverTransport := &TCPTransport{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}}
+	s, err := StartServer("127.0.0.1:0", &ServerConfig{Transport: serverTransport, Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.listen.Addr().String()
+
+	c, err := ClientDialAndHandshake(addr, &ClientConfig{Encryption: true, Transport: &TCPTransport{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mustExchange(t, 10, c.Send, s.Receive)
+	mustExchange(t, 10, s.Send, c.Receive)
+}
+
+func TestTCPTransportUntrustedServer(t *testing.T) {
+	cert, _ := selfSignedCertificate(t)
+	s, err := StartServer("127.0.0.1:0", &ServerConfig{Transport: &TCPTransport{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	transport := &TCPTransport{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+	_, err = transport.Dial(t.Context(), s.listen.Addr().String())
+	if !errors.Is(err, ErrDialPermanent) {
+		t.Errorf("dialing an untrusted server returned %v, expected ErrDialPermanent", err)
+	}
+	_, err = ClientDialAndHandshake(s.listen.Addr().String(), &ClientConfig{Transport: transport, Timeout: 5 * time.Second})
+	if !errors.Is(err, ErrDialPermanent) {
+		t.Errorf("client connecting to an untrusted server returned %v, expected ErrDialPermanent", err)
+	}
+}
@@ -4,70 +4,52 @@
 package ipc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/Microsoft/go-winio"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
+	"golang.org/x/sys/windows"
+	"net"
 	"path/filepath"
-	"strings"
-	"time"
 )
 
 var defaultSocketBasePath = `\\.\pipe\`
 
-// Create the named pipe (if it doesn't already exist) and start listening for a client to connect.
-// when a client connects and connection is accepted the serverReadDataFromConnectionToIncomingChannel function is called on a go routine.
-func (s *Server) serverRun() error {
-	socketPath := filepath.Join(s.conf.SocketBasePath, s.Name)
+// NamedPipeTransport - connects client and server over the named pipe SocketBasePath\<ipc name>
+type NamedPipeTransport struct {
+	SocketBasePath    string
+	UnmaskPermissions bool // allow any authenticated user to connect
+}
+
+func newDefaultTransport(conf ServerConfig) Transport {
+	unmaskPermissions := conf.UnmaskPermissions || conf.SocketFileMode&0002 != 0 // SocketOwner/SocketGroup don't apply to named pipes
+	return &NamedPipeTransport{SocketBasePath: conf.SocketBasePath, UnmaskPermissions: unmaskPermissions}
+}
+
+// Listen creates the named pipe (if it doesn't already exist) and starts listening for a client to connect.
+func (t *NamedPipeTransport) Listen(name string) (net.Listener, error) {
 	var config *winio.PipeConfig
 
-	if s.conf.UnmaskPermissions {
+	if t.UnmaskPermissions {
 		config = &winio.PipeConfig{SecurityDescriptor: "D:P(A;;GA;;;AU)"}
 	}
 
-	listen, err := winio.ListenPipe(socketPath, config)
-	if err != nil {
-		return err
-	}
-	s.listen = listen
-	s.status = SListening
-	s.statusChannel <- SListening
-
-	log.Debugln("server ok connected to namedPipe ... waiting for clients to connect...")
-	return nil
+	return winio.ListenPipe(filepath.Join(t.SocketBasePath, name), config)
 }
 
-// clientDialAndHandshakeToServer - attempts to connect to a named pipe created by the server
-func (c *Client) clientDialAndHandshakeToServer() error {
-	socketPath := filepath.Join(c.conf.SocketBasePath, c.Name)
-	startTime := time.Now()
-
-	for {
-		if c.conf.Timeout != 0 {
-			if time.Since(startTime) > c.conf.Timeout {
-				c.status = CError
-				c.statusChannel <- CError
-				return errors.New("client timed out trying to connect")
-			}
-		}
-
-		namedPipe, err := winio.DialPipe(socketPath, nil)
-		if err != nil {
-			if strings.Contains(err.Error(), "the system cannot find the file specified.") {
-				// waiting for the server to come up
-			} else {
-				return err
-			}
-		} else {
-			c.conn = namedPipe
-			log.Debugln("client connected to server namedPipe ... now waiting for server handshake")
-			err = c.clientDoPassiveHandshake()
-			if err != nil {
-				return err
-			}
-
-			return nil
-		}
-
-		time.Sleep(c.conf.RetryTimer * time.Second)
+// Dial attempts to connect to a named pipe created by the server
+func (t *NamedPipeTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	namedPipe, err := winio.DialPipeContext(ctx, filepath.Join(t.SocketBasePath, name))
+	if dialErrorIsPermanent(err) {
+		return nil, fmt.Errorf("%w: %w", ErrDialPermanent, err)
 	}
+	return namedPipe, err
+}
+
+// dialErrorIsPermanent - retrying won't help if the client may not open the pipe or its name is invalid.
+// Anything else (no pipe yet, all instances busy, timeouts, cancellation) may go away while retrying.
+func dialErrorIsPermanent(err error) bool {
+	return errors.Is(err, windows.ERROR_ACCESS_DENIED) ||
+		errors.Is(err, windows.ERROR_INVALID_NAME) ||
+		errors.Is(err, windows.ERROR_BAD_PATHNAME)
 }
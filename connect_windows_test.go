@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"os"
+	"testing"
+)
+
+func TestDialErrorIsPermanent(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		permanent bool
+	}{
+		{&os.PathError{Op: "open", Path: `\\.\pipe\test`, Err: windows.ERROR_ACCESS_DENIED}, true},
+		{&os.PathError{Op: "open", Path: `\\.\pipe\te|st`, Err: windows.ERROR_INVALID_NAME}, true},
+		{&os.PathError{Op: "open", Path: `\\.\pipe\test`, Err: windows.ERROR_FILE_NOT_FOUND}, false},
+		{&os.PathError{Op: "open", Path: `\\.\pipe\test`, Err: windows.ERROR_PIPE_BUSY}, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("dial: %w", context.Canceled), false},
+		{nil, false},
+	} {
+		if permanent := dialErrorIsPermanent(test.err); permanent != test.permanent {
+			t.Errorf("%v: permanent %v, expected %v", test.err, permanent, test.permanent)
+		}
+	}
+}
+
+func TestNamedPipeTransportRetriesWithoutServer(t *testing.T) {
+	transport := &NamedPipeTransport{SocketBasePath: defaultSocketBasePath}
+	_, err := transport.Dial(context.Background(), "golang-ipc-test-nobody-listening")
+	if err == nil || dialErrorIsPermanent(err) {
+		t.Errorf("dialing a missing pipe returned %v, expected a temporary error", err)
+	}
+}
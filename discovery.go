@@ -0,0 +1,72 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// manifestExt - servers listening on a socket file publish their Manifest in <socket file>.manifest (JSON)
+const manifestExt = ".manifest"
+
+// Manifest - describes a running server, published next to its socket file and read by Discover
+type Manifest struct {
+	Name         string    `json:"name"`    // ipc name to connect to
+	PID          int       `json:"pid"`     // process id of the server
+	Version      int       `json:"version"` // ipc protocol version
+	Capabilities []string  `json:"capabilities,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+}
+
+// Endpoint - a live server found by Discover
+type Endpoint struct {
+	Manifest
+	SocketBasePath string // the SocketBasePath to connect with
+}
+
+// DiscoverFilter - selects the endpoints returned by Discover, empty fields match every endpoint
+type DiscoverFilter struct {
+	SocketBasePath string // directory to search in ("": the default socket base path)
+	Name           string // ipc name of the server
+	Capability     string // the server has to offer this capability
+}
+
+func (f DiscoverFilter) matches(m Manifest) bool {
+	if f.Name != "" && f.Name != m.Name {
+		return false
+	}
+	if f.Capability == "" {
+		return true
+	}
+	for _, capability := range m.Capabilities {
+		if capability == f.Capability {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverAndDial - connects to the most recently started live server matching the filter (see Discover and ClientDialAndHandshake)
+func DiscoverAndDial(filter DiscoverFilter, config *ClientConfig) (*Client, error) {
+	endpoints, err := Discover(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New(fmt.Sprintf("no server found for name '%s' and capability '%s'", filter.Name, filter.Capability))
+	}
+
+	newest := endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		if endpoint.StartedAt.After(newest.StartedAt) {
+			newest = endpoint
+		}
+	}
+
+	conf := DefaultClientConfig
+	if config != nil {
+		conf = *config
+	}
+	conf.SocketBasePath = newest.SocketBasePath
+	return ClientDialAndHandshake(newest.Name, &conf)
+}
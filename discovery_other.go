@@ -0,0 +1,129 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// publishManifest writes the server's Manifest next to its socket file (servers on abstract sockets or other transports have none)
+func (s *Server) publishManifest() {
+	addr, ok := s.listen.Addr().(*net.UnixAddr)
+	if !ok || addr.Name == "" || strings.HasPrefix(addr.Name, "@") {
+		return
+	}
+
+	manifest := Manifest{
+		Name:         s.Name,
+		PID:          os.Getpid(),
+		Version:      ipcVersion,
+		Capabilities: s.conf.Capabilities,
+		StartedAt:    time.Now(),
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		s.log.Warn("could not publish manifest", "error", err)
+		return
+	}
+
+	manifestPath := addr.Name + manifestExt
+	tmpPath := manifestPath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, manifestPath) // readers never see a partial manifest
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		s.log.Warn("could not publish manifest", "path", manifestPath, "error", err)
+		return
+	}
+	s.manifestPath = manifestPath
+}
+
+func (s *Server) removeManifest() {
+	if s.manifestPath != "" {
+		os.Remove(s.manifestPath)
+		s.manifestPath = ""
+	}
+}
+
+// Discover - lists the live servers that published their Manifest in the filter's SocketBasePath (including sub-directories)
+func Discover(filter DiscoverFilter) ([]Endpoint, error) {
+	basePath := filter.SocketBasePath
+	if basePath == "" {
+		basePath = defaultSocketBasePath
+	}
+
+	var endpoints []Endpoint
+	err := filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == basePath {
+				return err
+			}
+			return nil // skip what we're not allowed to read
+		}
+		if d.IsDir() || !strings.HasSuffix(path, defaultSocketExt+manifestExt) {
+			return nil
+		}
+
+		manifest, ok := readManifest(basePath, path)
+		if ok && filter.matches(manifest) && endpointAlive(manifest, strings.TrimSuffix(path, manifestExt)) {
+			endpoints = append(endpoints, Endpoint{Manifest: manifest, SocketBasePath: basePath})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// readManifest reads a Manifest, ignoring those whose name doesn't match their location
+func readManifest(basePath string, path string) (Manifest, bool) {
+	var manifest Manifest
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &manifest) != nil {
+		return manifest, false
+	}
+
+	rel, err := filepath.Rel(basePath, strings.TrimSuffix(path, defaultSocketExt+manifestExt))
+	if err != nil || filepath.ToSlash(rel) != filepath.ToSlash(manifest.Name) {
+		return manifest, false
+	}
+	return manifest, true
+}
+
+// endpointAlive checks if the server still holds the lock of its socket or, for servers without one (e.g. socket activated), if its process is still running
+func endpointAlive(manifest Manifest, socketPath string) bool {
+	if _, err := os.Stat(socketPath); err != nil {
+		return false
+	}
+
+	lock, err := os.Open(socketPath + ".lock")
+	if err == nil {
+		defer lock.Close()
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		if err == nil {
+			// nobody holds the lock: the server is gone, even if its PID was reused meanwhile
+			syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+			return false
+		}
+		return errors.Is(err, syscall.EWOULDBLOCK)
+	}
+	if !os.IsNotExist(err) && !os.IsPermission(err) {
+		return false
+	}
+
+	// no lock file to check (or one of another user we may not open)
+	err = syscall.Kill(manifest.PID, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
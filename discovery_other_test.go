@@ -0,0 +1,90 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	basePath := shortTempDir(t) + "/"
+	s, err := StartServer("tools/test", &ServerConfig{SocketBasePath: basePath, Capabilities: []string{"echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	endpoints, err := Discover(DiscoverFilter{SocketBasePath: basePath, Capability: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Name != "tools/test" || endpoints[0].PID != os.Getpid() || endpoints[0].SocketBasePath != basePath {
+		t.Fatalf("discovered %+v", endpoints)
+	}
+	for _, filter := range []DiscoverFilter{{Name: "other"}, {Capability: "other"}} {
+		filter.SocketBasePath = basePath
+		if endpoints, _ := Discover(filter); len(endpoints) != 0 {
+			t.Errorf("filter %+v matched %+v", filter, endpoints)
+		}
+	}
+
+	c, err := DiscoverAndDial(DiscoverFilter{SocketBasePath: basePath, Name: "tools/test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mustExchange(t, 1, c.Send, s.Receive)
+
+	s.Close()
+	if endpoints, _ := Discover(DiscoverFilter{SocketBasePath: basePath}); len(endpoints) != 0 {
+		t.Errorf("discovered %+v after the server closed", endpoints)
+	}
+}
+
+// writeStaleEndpoint leaves a socket file and manifest behind, like a server that crashed
+func writeStaleEndpoint(t *testing.T, basePath string, name string, pid int, withLock bool) {
+	t.Helper()
+	socketPath := filepath.Join(basePath, name+defaultSocketExt)
+	crashed, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.SetUnlinkOnClose(false)
+	crashed.Close()
+	if withLock {
+		if err := os.WriteFile(socketPath+".lock", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(Manifest{Name: name, PID: pid, Version: ipcVersion, StartedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(socketPath+manifestExt, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoverSkipsStaleManifests(t *testing.T) {
+	basePath := shortTempDir(t) + "/"
+	// the PID of a crashed server may belong to another (running) process by now, the unlocked lock file tells it's gone
+	writeStaleEndpoint(t, basePath, "unlocked", os.Getpid(), true)
+	writeStaleEndpoint(t, basePath, "dead", math.MaxInt32, false)
+	if endpoints, err := Discover(DiscoverFilter{SocketBasePath: basePath}); err != nil || len(endpoints) != 0 {
+		t.Errorf("discovered %+v, %v from stale manifests", endpoints, err)
+	}
+
+	// without a lock file (e.g. socket activated), the running process counts
+	writeStaleEndpoint(t, basePath, "activated", os.Getpid(), false)
+	endpoints, err := Discover(DiscoverFilter{SocketBasePath: basePath})
+	if err != nil || len(endpoints) != 1 || endpoints[0].Name != "activated" {
+		t.Errorf("discovered %+v, %v", endpoints, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import "errors"
+
+// named pipes have no directory to publish a Manifest in
+func (s *Server) publishManifest() {}
+
+func (s *Server) removeManifest() {}
+
+// Discover - not available on windows
+func Discover(filter DiscoverFilter) ([]Endpoint, error) {
+	return nil, errors.New("discovery is not supported on windows")
+}
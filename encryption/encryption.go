@@ -4,16 +4,38 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"io"
 )
 
-var ellipticCurve = elliptic.P384() // sharedSecretByteLength = 48 marshalledPublicKeyByteLength = 97 + 1
-//var ellipticCurve = elliptic.P256() // sharedSecretByteLength = 32 marshalledPublicKeyByteLength = 65 + 1
+// CipherSuite - the AEAD cipher used for an encrypted connection
+type CipherSuite byte
+
+const (
+	AES256GCM        CipherSuite = iota + 1 // 1
+	ChaCha20Poly1305                        // 2 faster than AES on hardware without AES instructions
+)
+
+func (cs CipherSuite) String() string {
+	switch cs {
+	case AES256GCM:
+		return "AES256GCM"
+	case ChaCha20Poly1305:
+		return "ChaCha20Poly1305"
+	default:
+		return "<Unknown>"
+	}
+}
+
+// Cipher - seals and opens messages with a symmetric key
+type Cipher interface {
+	Seal(plain []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
 
 func NewX25519KeyPair() (*ecdh.PrivateKey, error) {
 	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
@@ -34,43 +56,91 @@ func SharedSecretX25519(privKeyBytes []byte, peerPubKeyBytes []byte) ([32]byte,
 	return sha256.Sum256(sharedSecret), nil
 }
 
-// CreateGcmCipherFromX25519SharedKey creates an Authenticated encryption with associated data (AEAD) cipher
-// using the generated and sha256 hashed sharedSecretSha256 calculated from "other-side"'s public ecdsa-key and own private ecdsa-key
-func CreateGcmCipherFromX25519SharedKey(sharedSecret [sha256.Size]byte) (*cipher.AEAD, error) {
-	b, err := aes.NewCipher(sharedSecret[:])
+// NewCipher creates the Authenticated encryption with associated data (AEAD) Cipher of the given CipherSuite
+// using the sha256 hashed shared secret calculated from "other-side"'s public key and own private key
+func NewCipher(suite CipherSuite, sharedSecret [sha256.Size]byte) (Cipher, error) {
+	var aead cipher.AEAD
+	var err error
+	switch suite {
+	case AES256GCM:
+		var b cipher.Block
+		b, err = aes.NewCipher(sharedSecret[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err = cipher.NewGCM(b)
+	case ChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(sharedSecret[:])
+	default:
+		return nil, errors.New("unknown cipher suite " + suite.String())
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	aesGCM, err := cipher.NewGCM(b)
+	return &aeadCipher{aead: aead}, nil
+}
+
+// NewCipherFromKeyExchange creates the Cipher of the given CipherSuite from own private key and "other-side"'s public key
+func NewCipherFromKeyExchange(suite CipherSuite, ownPrivateKey *ecdh.PrivateKey, peerPublicKey []byte) (Cipher, error) {
+	sharedSecret, err := SharedSecretX25519(ownPrivateKey.Bytes(), peerPublicKey)
 	if err != nil {
 		return nil, err
 	}
+	return NewCipher(suite, sharedSecret)
+}
 
-	return &aesGCM, nil
+// aeadCipher prepends a random nonce to each sealed message
+type aeadCipher struct {
+	aead cipher.AEAD
 }
 
-func Encrypt(cipher *cipher.AEAD, data []byte) ([]byte, error) {
-	nonce := make([]byte, (*cipher).NonceSize())
+func (c *aeadCipher) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
 	_, err := io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		return nil, err
 	}
 
-	return (*cipher).Seal(nonce, nonce, data, nil), err
+	return c.aead.Seal(nonce, nonce, data, nil), nil
 }
 
-func Decrypt(cipher *cipher.AEAD, encodedData []byte) ([]byte, error) {
-	nonceSize := (*cipher).NonceSize()
+func (c *aeadCipher) Open(encodedData []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
 	if len(encodedData) < nonceSize {
 		return nil, errors.New("not enough data to decrypt")
 	}
 
 	nonce, encodedData := encodedData[:nonceSize], encodedData[nonceSize:]
-	plain, err := (*cipher).Open(nil, nonce, encodedData, nil)
+	plain, err := c.aead.Open(nil, nonce, encodedData, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	return plain, nil
 }
+
+// CreateGcmCipherFromX25519SharedKey creates an AES 256 GCM AEAD cipher from the sha256 hashed shared secret.
+//
+// Deprecated: use NewCipher(AES256GCM, sharedSecret), whose Cipher seals and opens with the same format.
+func CreateGcmCipherFromX25519SharedKey(sharedSecret [sha256.Size]byte) (*cipher.AEAD, error) {
+	c, err := NewCipher(AES256GCM, sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &c.(*aeadCipher).aead, nil
+}
+
+// Encrypt seals data with a random nonce prepended.
+//
+// Deprecated: use Cipher.Seal.
+func Encrypt(aead *cipher.AEAD, data []byte) ([]byte, error) {
+	return (&aeadCipher{aead: *aead}).Seal(data)
+}
+
+// Decrypt opens data sealed by Encrypt.
+//
+// Deprecated: use Cipher.Open.
+func Decrypt(aead *cipher.AEAD, encodedData []byte) ([]byte, error) {
+	return (&aeadCipher{aead: *aead}).Open(encodedData)
+}
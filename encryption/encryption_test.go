@@ -0,0 +1,86 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	secret := sha256.Sum256([]byte("shared secret"))
+	for _, suite := range []CipherSuite{AES256GCM, ChaCha20Poly1305} {
+		c, err := NewCipher(suite, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := c.Seal([]byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened, err := c.Open(sealed)
+		if err != nil || string(opened) != "message" {
+			t.Errorf("%s: opened %q, %v", suite, opened, err)
+		}
+		again, _ := c.Seal([]byte("message"))
+		if string(again) == string(sealed) {
+			t.Errorf("%s: sealed the same message twice to the same bytes", suite)
+		}
+	}
+	if _, err := NewCipher(CipherSuite(0), secret); err == nil {
+		t.Error("created a cipher of an unknown suite")
+	}
+}
+
+func TestCipherRejectsTamperedData(t *testing.T) {
+	secret := sha256.Sum256([]byte("shared secret"))
+	for _, suite := range []CipherSuite{AES256GCM, ChaCha20Poly1305} {
+		c, err := NewCipher(suite, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := c.Seal([]byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range sealed { // nonce, ciphertext and tag
+			tampered := append([]byte(nil), sealed...)
+			tampered[i] ^= 1
+			if _, err := c.Open(tampered); err == nil {
+				t.Fatalf("%s: opened data tampered at byte %d", suite, i)
+			}
+		}
+		if _, err := c.Open(sealed[:len(sealed)-1]); err == nil {
+			t.Errorf("%s: opened truncated data", suite)
+		}
+		other, _ := NewCipher(suite, sha256.Sum256([]byte("other secret")))
+		if _, err := other.Open(sealed); err == nil {
+			t.Errorf("%s: opened data with another key", suite)
+		}
+	}
+}
+
+func TestDeprecatedGcmFunctions(t *testing.T) {
+	secret := sha256.Sum256([]byte("shared secret"))
+	aead, err := CreateGcmCipherFromX25519SharedKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Encrypt(aead, []byte("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same format as an AES256GCM Cipher
+	c, err := NewCipher(AES256GCM, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := c.Open(sealed); err != nil || string(opened) != "message" {
+		t.Errorf("Cipher opened %q, %v", opened, err)
+	}
+	sealed, err = c.Seal([]byte("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := Decrypt(aead, sealed); err != nil || string(opened) != "reply" {
+		t.Errorf("Decrypt opened %q, %v", opened, err)
+	}
+}
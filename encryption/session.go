@@ -0,0 +1,172 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session - the symmetric encryption state of one connection, created by an X25519 key exchange.
+//
+// Outgoing messages are sealed with the send Cipher, incoming ones opened with the receive Cipher.
+// Both are the same after the key exchange, but switch independently while the keys are rotated (rekey):
+//
+//	initiator: pub := StartRekey()                  -> send pub (sealed with the old key)
+//	responder: pub := RespondRekey(peerPub)         -> send pub (sealed with the old key), then ActivateSend()
+//	initiator: CompleteRekey(peerPub), ActivateRecv -> send commit (sealed with the old key), then ActivateSend()
+//	responder: on commit ActivateRecv()
+//
+// As long as messages of the underlying connection are ordered, no message is ever opened with the wrong key.
+type Session struct {
+	mutex       sync.Mutex
+	suite       CipherSuite
+	send        Cipher
+	recv        Cipher
+	nextSend    Cipher
+	nextRecv    Cipher
+	pendingKey  *ecdh.PrivateKey
+	frames      atomic.Uint64 // messages sealed and opened with the current keys
+	keyCreated  time.Time
+	rekeyActive bool
+}
+
+// NewSession creates a Session of the given CipherSuite from own private key and "other-side"'s public key
+func NewSession(suite CipherSuite, ownPrivateKey *ecdh.PrivateKey, peerPublicKey []byte) (*Session, error) {
+	c, err := NewCipherFromKeyExchange(suite, ownPrivateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionFromCipher(suite, c), nil
+}
+
+// NewSessionFromCipher creates a Session using the given Cipher in both directions
+func NewSessionFromCipher(suite CipherSuite, c Cipher) *Session {
+	return &Session{
+		suite:      suite,
+		send:       c,
+		recv:       c,
+		keyCreated: time.Now(),
+	}
+}
+
+func (s *Session) Suite() CipherSuite {
+	return s.suite
+}
+
+// Seal encrypts an outgoing message with the current send key
+func (s *Session) Seal(plain []byte) ([]byte, error) {
+	s.mutex.Lock()
+	c := s.send
+	s.mutex.Unlock()
+	s.frames.Add(1)
+	return c.Seal(plain)
+}
+
+// Open decrypts an incoming message with the current receive key
+func (s *Session) Open(sealed []byte) ([]byte, error) {
+	s.mutex.Lock()
+	c := s.recv
+	s.mutex.Unlock()
+	s.frames.Add(1)
+	return c.Open(sealed)
+}
+
+// RekeyDue reports if the current keys have been used for afterFrames messages or for afterDuration and no rekey is in progress
+func (s *Session) RekeyDue(afterFrames uint64, afterDuration time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rekeyActive {
+		return false
+	}
+	return s.frames.Load() >= afterFrames || time.Since(s.keyCreated) >= afterDuration
+}
+
+// StartRekey generates a new key pair and returns its public key, which has to be sent to the other side
+func (s *Session) StartRekey() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.rekeyActive {
+		return nil, errors.New("rekey already in progress")
+	}
+
+	priv, err := NewX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s.pendingKey = priv
+	s.rekeyActive = true
+	return priv.PublicKey().Bytes(), nil
+}
+
+// RespondRekey answers the other side's StartRekey: it returns own new public key and stages the new keys
+func (s *Session) RespondRekey(peerPublicKey []byte) ([]byte, error) {
+	priv, err := NewX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCipherFromKeyExchange(s.suite, priv, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextSend = c
+	s.nextRecv = c
+	s.rekeyActive = true
+	return priv.PublicKey().Bytes(), nil
+}
+
+// CompleteRekey stages the new keys from the other side's RespondRekey public key
+func (s *Session) CompleteRekey(peerPublicKey []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pendingKey == nil {
+		return errors.New("received rekey response without a pending rekey")
+	}
+
+	c, err := NewCipherFromKeyExchange(s.suite, s.pendingKey, peerPublicKey)
+	if err != nil {
+		return err
+	}
+	s.pendingKey = nil
+	s.nextSend = c
+	s.nextRecv = c
+	return nil
+}
+
+// ActivateSend switches outgoing messages to the staged key
+func (s *Session) ActivateSend() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nextSend == nil {
+		return errors.New("no staged send key")
+	}
+	s.send = s.nextSend
+	s.nextSend = nil
+	s.finishRekeyLocked()
+	return nil
+}
+
+// ActivateRecv switches incoming messages to the staged key
+func (s *Session) ActivateRecv() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nextRecv == nil {
+		return errors.New("no staged receive key")
+	}
+	s.recv = s.nextRecv
+	s.nextRecv = nil
+	s.finishRekeyLocked()
+	return nil
+}
+
+func (s *Session) finishRekeyLocked() {
+	if s.nextSend == nil && s.nextRecv == nil {
+		s.rekeyActive = false
+		s.frames.Store(0)
+		s.keyCreated = time.Now()
+	}
+}
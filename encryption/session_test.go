@@ -0,0 +1,166 @@
+package encryption
+
+import (
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T, suite CipherSuite) (initiator *Session, responder *Session) {
+	t.Helper()
+	initiatorKey, err := NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderKey, err := NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator, err = NewSession(suite, initiatorKey, responderKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err = NewSession(suite, responderKey, initiatorKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func transfer(t *testing.T, from *Session, to *Session, message string) {
+	t.Helper()
+	sealed, err := from.Seal([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := to.Open(sealed)
+	if err != nil {
+		t.Fatalf("%q: %v", message, err)
+	}
+	if string(opened) != message {
+		t.Fatalf("opened %q, expected %q", opened, message)
+	}
+}
+
+// rekey runs the rekey protocol with frames in flight in both directions, in the order the connection would deliver them
+func rekey(t *testing.T, initiator *Session, responder *Session) {
+	t.Helper()
+	request, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlightToResponder, err := initiator.Seal([]byte("sent after the request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := responder.RespondRekey(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlightToInitiator, err := responder.Seal([]byte("sent before the response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.ActivateSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.Open(inFlightToResponder); err != nil {
+		t.Fatalf("frame sent with the old key after the request: %v", err)
+	}
+
+	if _, err := initiator.Open(inFlightToInitiator); err != nil {
+		t.Fatalf("frame sent with the old key before the response: %v", err)
+	}
+	if err := initiator.CompleteRekey(response); err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.ActivateRecv(); err != nil {
+		t.Fatal(err)
+	}
+	transfer(t, responder, initiator, "responder sends with the new key")
+	commit, err := initiator.Seal([]byte("commit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.ActivateSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := responder.Open(commit); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := responder.ActivateRecv(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeySwitchesBothDirections(t *testing.T) {
+	for _, suite := range []CipherSuite{AES256GCM, ChaCha20Poly1305} {
+		initiator, responder := newSessionPair(t, suite)
+		transfer(t, initiator, responder, "before")
+		oldKeySealed, err := initiator.Seal([]byte("old key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rekey(t, initiator, responder)
+		transfer(t, initiator, responder, "initiator to responder")
+		transfer(t, responder, initiator, "responder to initiator")
+		if _, err := responder.Open(oldKeySealed); err == nil {
+			t.Errorf("%s: a frame sealed with the old key opened after the rekey", suite)
+		}
+
+		rekey(t, initiator, responder) // and again
+		transfer(t, initiator, responder, "after the second rekey")
+		transfer(t, responder, initiator, "after the second rekey")
+	}
+}
+
+func TestRekeyDue(t *testing.T) {
+	initiator, responder := newSessionPair(t, AES256GCM)
+	if initiator.RekeyDue(4, time.Hour) {
+		t.Fatal("rekey due on a new session")
+	}
+	for i := 0; i < 2; i++ {
+		transfer(t, initiator, responder, "frame")
+	}
+	if !initiator.RekeyDue(2, time.Hour) {
+		t.Error("rekey not due after the frames")
+	}
+	if !initiator.RekeyDue(1000, time.Nanosecond) {
+		t.Error("rekey not due after the duration")
+	}
+
+	if _, err := initiator.StartRekey(); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.RekeyDue(1, time.Nanosecond) {
+		t.Error("rekey due while a rekey is in progress")
+	}
+	if _, err := initiator.StartRekey(); err == nil {
+		t.Error("started a second rekey while one is in progress")
+	}
+}
+
+func TestRekeyResponseWithoutRequest(t *testing.T) {
+	initiator, responder := newSessionPair(t, AES256GCM)
+	response, err := responder.RespondRekey(mustPublicKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.CompleteRekey(response); err == nil {
+		t.Error("completed a rekey that was never started")
+	}
+	if err := initiator.ActivateSend(); err == nil {
+		t.Error("activated a send key that was never staged")
+	}
+}
+
+func mustPublicKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewX25519KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey().Bytes()
+}
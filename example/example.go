@@ -1,29 +1,34 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	ipc "github.com/hoffigolang/golang-ipc"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
 	//m "github.com/hoffigolang/golang-ipc/msg"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
+	"log"
+	"log/slog"
 	"math"
+	"os"
 	"time"
 )
 
 func main() {
-	log.DoDebug = true
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})) // run with GOLANG_IPC_DEBUG=1 to see the debug logs
 
 	//msg := m.NewStringMsg("hello World")
 	//fmt.Println(msg.S())
 	//syscall.Exit(0)
 
 	serverConfig := &ipc.ServerConfig{
-		SocketBasePath:    ipc.DefaultServerConfig.SocketBasePath,
-		Timeout:           ipc.DefaultServerConfig.Timeout,
-		MaxMsgSize:        ipc.DefaultServerConfig.MaxMsgSize,
-		Encryption:        true,
-		UnmaskPermissions: true, // true will make the socket writable for any user
+		SocketBasePath: ipc.DefaultServerConfig.SocketBasePath,
+		Timeout:        ipc.DefaultServerConfig.Timeout,
+		MaxMsgSize:     ipc.DefaultServerConfig.MaxMsgSize,
+		Encryption:     true,
+		SocketFileMode: 0666, // makes the socket writable for any user
+		Logger:         logger,
 	}
 	clientConfig := &ipc.ClientConfig{
 		SocketBasePath: ipc.DefaultClientConfig.SocketBasePath,
@@ -31,6 +36,7 @@ func main() {
 		RetryTimer:     ipc.DefaultClientConfig.RetryTimer,
 		MaxMsgSize:     ipc.DefaultClientConfig.MaxMsgSize,
 		Encryption:     true,
+		Logger:         logger,
 	}
 
 	waitForServerListening := make(chan bool)
@@ -76,14 +82,14 @@ func client(ipcName string, clientConfig *ipc.ClientConfig) {
 		}
 
 		log.Printf("expected time to send %s msgs is ~%ds", printer.Sprintf("%d", msgCount), int(math.Round(float64(msgCount)*faktor))+1)
-		log.PauseLogging()
 	}
 	for i := 0; i < msgCount; i++ {
 		m := fmt.Sprintf("Msg: %2d", i+1)
-		log.Printf("client sending '%s'", m)
+		if msgCount < 50 {
+			log.Printf("client sending '%s'", m)
+		}
 		c.Send(ipc.String, []byte(m))
 	}
-	log.ContinueLogging()
 	log.Printf("client sending %s msgs took %s", printer.Sprintf("%d", msgCount), time.Since(start))
 
 	log.Println("client sending <action>")
@@ -119,6 +125,7 @@ func client(ipcName string, clientConfig *ipc.ClientConfig) {
 
 func server(ipcName string, serverConfig *ipc.ServerConfig, wait chan bool) {
 	log.Printf("starting server '%s'.", ipcName)
+	serverConfig.ServeInOrder = true // reply to the client's messages in the order sent
 	s, err := ipc.StartServer(ipcName, serverConfig)
 	if err != nil {
 		log.Println("server error", err)
@@ -128,31 +135,25 @@ func server(ipcName string, serverConfig *ipc.ServerConfig, wait chan bool) {
 
 	log.Printf("server status: %s", s.Status())
 
-	for {
-		msg, err := s.Receive()
-
-		if err == nil {
-			msgData := string(msg.Data)
-			log.Printf("server received Msg: '%s' - Message type: %d", msgData, msg.MsgType)
-			if msgData == ipc.IntermediateActionMessage {
-				log.Printf("server received INTERMEDIATE '%s' ... reply to action with %f.", msgData, 3.1415926535)
-				err := s.Send(ipc.Float, []byte("3.1415926535"))
-				if err != nil {
-					panic(err)
-				}
-			} else if msgData == ipc.FinalMessage {
-				log.Printf("server received FINAL '%s' from  client", msgData)
-				log.Println("server CLOSEs connection.")
-				s.Close()
-				return
-			} else if msgData == ipc.InitialMessage {
-				err := s.Send(ipc.Float, []byte("2.71828"))
-				if err != nil {
-					panic(err)
-				}
+	handler := func(ctx context.Context, session *ipc.Session, msg *ipc.Message) {
+		msgData := string(msg.Data)
+		if msgData == ipc.IntermediateActionMessage {
+			log.Printf("server received INTERMEDIATE '%s' ... reply to action with %f.", msgData, 3.1415926535)
+			err := session.Send(ipc.Float, []byte("3.1415926535"))
+			if err != nil {
+				panic(err) // the client receives an ipc.RemoteError
+			}
+		} else if msgData == ipc.FinalMessage {
+			log.Printf("server received FINAL '%s' from  client", msgData)
+			log.Println("server CLOSEs connection.")
+			s.Close()
+		} else if msgData == ipc.InitialMessage {
+			err := session.Send(ipc.Float, []byte("2.71828"))
+			if err != nil {
+				panic(err)
 			}
-		} else {
-			break
 		}
 	}
+	err = s.Serve(handler)
+	log.Println("server stopped serving:", err)
 }
@@ -0,0 +1,100 @@
+package ipc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrFDPassingNotSupported - returned by SendFDs if the connection can't carry file descriptors (named pipes, tcp, ...)
+var ErrFDPassingNotSupported = errors.New("file descriptor passing is only supported on unix sockets")
+
+const maxFDsPerMessage = 253 // SCM_MAX_FD of linux
+
+// connReader reads from the connection and collects the file descriptors received alongside the data (unix sockets only).
+// a messageWithFiles frame takes its files from the collected ones in the order they were received.
+type connReader struct {
+	conn     net.Conn
+	unixConn *net.UnixConn
+	oob      []byte
+	files    []*os.File
+}
+
+func (r *connReader) takeFiles(count int) ([]*os.File, error) {
+	if count > len(r.files) {
+		err := errors.New(fmt.Sprintf("message announces %d files, only %d were received", count, len(r.files)))
+		r.closeUnclaimedFiles()
+		return nil, err
+	}
+	files := r.files[:count:count]
+	r.files = r.files[count:]
+	return files, nil
+}
+
+// closeUnclaimedFiles closes the files no frame took (frames that failed or didn't announce them, a connection lost mid-frame),
+// called by the reading goroutine after each frame and when it stops
+func (r *connReader) closeUnclaimedFiles() {
+	closeFiles(r.files)
+	r.files = nil
+}
+
+// messageWithFiles frame: MsgType of the message + count of passed files as uint32 in big endian, followed by the message
+func encodeMessageWithFiles(msgType MsgType, fileCount int, data []byte) []byte {
+	buff := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buff[:4], uint32(msgType))
+	binary.BigEndian.PutUint32(buff[4:8], uint32(fileCount))
+	return append(buff, data...)
+}
+
+func decodeMessageWithFiles(data []byte) (MsgType, int, []byte, error) {
+	if len(data) < 8 {
+		return 0, 0, nil, errors.New("message with files is too short")
+	}
+	return bytesToMsgType(data[:4]), bytesToInt(data[4:8]), data[8:], nil
+}
+
+// receiveMessageWithFiles turns a received messageWithFiles frame into a Message with Files
+func receiveMessageWithFiles(reader *connReader, data []byte) (*Message, error) {
+	msgType, fileCount, msgData, err := decodeMessageWithFiles(data)
+	if err != nil {
+		return nil, err
+	}
+	files, err := reader.takeFiles(fileCount)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := newReceivedMessage(msgType, msgData)
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	msg.Files = files
+	return msg, nil
+}
+
+// newFilesMessage validates and duplicates the files to send, so the caller may close them right after SendFDs returned
+func newFilesMessage(conn net.Conn, msgType MsgType, data []byte, files []*os.File) (*Message, error) {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return nil, ErrFDPassingNotSupported
+	}
+	if len(files) > maxFDsPerMessage {
+		return nil, errors.New(fmt.Sprintf("cannot pass more than %d files with one message", maxFDsPerMessage))
+	}
+
+	dups, err := dupFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	msg := NewMessage(msgType, data)
+	msg.Files = dups
+	return msg, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
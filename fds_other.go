@@ -0,0 +1,89 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+func newConnReader(conn net.Conn) *connReader {
+	unixConn, _ := conn.(*net.UnixConn)
+	r := &connReader{conn: conn, unixConn: unixConn}
+	if unixConn != nil {
+		r.oob = make([]byte, syscall.CmsgSpace(maxFDsPerMessage*4))
+	}
+	return r
+}
+
+// Read reads from the connection, on unix sockets file descriptors passed alongside the data are collected
+func (r *connReader) Read(p []byte) (int, error) {
+	if r.unixConn == nil {
+		return r.conn.Read(p)
+	}
+
+	n, oobn, _, _, err := r.unixConn.ReadMsgUnix(p, r.oob)
+	if oobn > 0 {
+		r.collectFiles(r.oob[:oobn])
+	}
+	return n, err
+}
+
+func (r *connReader) collectFiles(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			r.files = append(r.files, os.NewFile(uintptr(fd), "ipc-received-fd"))
+		}
+	}
+}
+
+// writeFrameWithFiles writes the frame and passes the files' descriptors alongside (SCM_RIGHTS)
+func writeFrameWithFiles(conn net.Conn, frame []byte, files []*os.File) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ErrFDPassingNotSupported
+	}
+
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	n, _, err := unixConn.WriteMsgUnix(frame, syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+	if n < len(frame) {
+		_, err = unixConn.Write(frame[n:])
+	}
+	return err
+}
+
+func dupFiles(files []*os.File) ([]*os.File, error) {
+	dups := make([]*os.File, 0, len(files))
+	for _, f := range files {
+		if f == nil {
+			closeFiles(dups)
+			return nil, errors.New("cannot pass a nil file")
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			closeFiles(dups)
+			return nil, err
+		}
+		syscall.CloseOnExec(fd)
+		dups = append(dups, os.NewFile(uintptr(fd), f.Name()))
+	}
+	return dups, nil
+}
@@ -0,0 +1,221 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startUnixPair connects a server and client over a unix socket in a temporary directory
+func startUnixPair(t *testing.T, encryption bool) (*Server, *Client) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ipc") // t.TempDir() may exceed the maximum unix socket path length
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := StartServer("test", &ServerConfig{SocketBasePath: dir + "/", Encryption: encryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ClientDialAndHandshake("test", &ClientConfig{SocketBasePath: dir + "/", Encryption: encryption})
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+	return s, c
+}
+
+// openFiles returns the number of open file descriptors of the process
+func openFiles(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSendFDs(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		s, c := startUnixPair(t, encryption)
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.SendFDs(Custom, []byte("pipe"), w)
+		w.Close() // SendFDs passes a duplicate
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := s.Receive()
+		if err != nil || string(m.Data) != "pipe" || len(m.Files) != 1 {
+			t.Fatalf("server received %v, %v", m, err)
+		}
+		if _, err := m.Files[0].Write([]byte("through the passed fd")); err != nil {
+			t.Fatal(err)
+		}
+		m.Files[0].Close()
+		buff := make([]byte, 64)
+		n, err := r.Read(buff)
+		if err != nil || string(buff[:n]) != "through the passed fd" {
+			t.Errorf("read %q, %v", buff[:n], err)
+		}
+		r.Close()
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestUnclaimedFDsAreClosed(t *testing.T) {
+	s, c := startUnixPair(t, true)
+	defer s.Close()
+	defer c.Close()
+	before := openFiles(t)
+
+	// frames passing files they don't announce, as a misbehaving peer could send them
+	sendWithFiles := func(msgType MsgType, data []byte) {
+		t.Helper()
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		written := make(chan error, 1)
+		c.crypto.control <- func(conn net.Conn) error {
+			frame, err := c.crypto.sealFrame(msgType, data)
+			if err == nil {
+				err = writeFrameWithFiles(conn, frame, []*os.File{f})
+			}
+			written <- err
+			return err
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendWithFiles(Custom, []byte("no files announced"))
+	sendWithFiles(messageWithFiles, encodeMessageWithFiles(Custom, 3, []byte("more files announced than passed")))
+	sendWithFiles(messageWithFiles, []byte("short"))
+
+	for i := 0; i < 3; i++ {
+		m, err := s.Receive()
+		if err == nil && len(m.Files) > 0 {
+			t.Errorf("server received files with %q", m.Data)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for openFiles(t) > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d open files before, %d after receiving unclaimed ones", before, after)
+	}
+}
+
+func TestReservedTypeWithFDsIsRejected(t *testing.T) {
+	s, c := startUnixPair(t, false)
+	defer s.Close()
+	defer c.Close()
+	before := openFiles(t)
+
+	for _, msgType := range []MsgType{rekeyRequest, messageWithFiles, 0} {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an internal type wrapped in a messageWithFiles frame, as a misbehaving peer could send it
+		written := make(chan error, 1)
+		c.crypto.control <- func(conn net.Conn) error {
+			frame, err := c.crypto.sealFrame(messageWithFiles, encodeMessageWithFiles(msgType, 1, make([]byte, 32)))
+			if err == nil {
+				err = writeFrameWithFiles(conn, frame, []*os.File{f})
+			}
+			written <- err
+			return err
+		}
+		err = <-written
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := s.Receive(); err == nil {
+			t.Errorf("server received %+v with the reserved type %d", m, msgType)
+		}
+	}
+	if after := openFiles(t); after > before {
+		t.Errorf("%d open files before, %d after rejecting the messages", before, after)
+	}
+}
+
+func TestUnclaimedFDsAreClosedWhenTheConnectionIsLost(t *testing.T) {
+	client, server, err := socketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	before := openFiles(t)
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append(intToBytes(100), 1, 2, 3) // the rest of the frame never arrives
+	err = writeFrameWithFiles(client, frame, []*os.File{f})
+	f.Close()
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newConnReader(server)
+	_, err = readFrame(reader)
+	if err == nil {
+		t.Fatal("read a truncated frame")
+	}
+	if len(reader.files) != 1 {
+		t.Fatalf("%d files collected", len(reader.files))
+	}
+	reader.closeUnclaimedFiles()
+	if after := openFiles(t); after > before {
+		t.Errorf("%d open files before, %d after closing the unclaimed ones", before, after)
+	}
+}
+
+// readFrame reads one length-prefixed frame like the reading goroutines do
+func readFrame(reader *connReader) ([]byte, error) {
+	bLen := make([]byte, 4)
+	if _, err := io.ReadFull(reader, bLen); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, bytesToInt(bLen))
+	_, err := io.ReadFull(reader, frame)
+	return frame, err
+}
+
+func socketPair() (*net.UnixConn, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1], nil
+}
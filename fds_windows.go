@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"net"
+	"os"
+)
+
+func newConnReader(conn net.Conn) *connReader {
+	return &connReader{conn: conn}
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	return r.conn.Read(p)
+}
+
+func writeFrameWithFiles(conn net.Conn, frame []byte, files []*os.File) error {
+	return ErrFDPassingNotSupported
+}
+
+func dupFiles(files []*os.File) ([]*os.File, error) {
+	return nil, ErrFDPassingNotSupported
+}
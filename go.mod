@@ -6,7 +6,7 @@ toolchain go1.24.1
 
 require (
 	github.com/Microsoft/go-winio v0.6.2
+	golang.org/x/crypto v0.32.0
+	golang.org/x/sys v0.29.0
 	golang.org/x/text v0.23.0
 )
-
-require golang.org/x/sys v0.29.0 // indirect
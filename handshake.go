@@ -1,41 +1,62 @@
 package ipc
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
+	"github.com/hoffigolang/golang-ipc/encryption"
+	"io"
+	"log/slog"
+	"net"
+	"time"
 )
 
+// every handshake message is length-prefixed: byte0-4 = length of the message as uint32 in big endian, followed by the message itself.
+// the whole handshake has to finish within the configured HandshakeTimeout.
+const maxHandshakeMsgSize = 1024
+
 // on connection wish of a client, the server initiates the handshake.
 // (handshake between client and server is done purely over the connection, no go channels involved)
-// handshake message 1: byte 0 = ipcVersion, byte 1 = exchange messages encrypted: =1, not-encrypted =0
-// handshake message 2 (optional): exchange encryption keys (and encrypt anything that goes over the wire afterward)
-// handshake message 3: byte0-4 = server's possible MaxMsgSize size as uint32 in big endian
-func (s *Server) serverHandshake() error {
-	err := s.serverSendAndReceiveHandshake1()
+// handshake message 1: byte 0 = ipcVersion, byte 1 = exchange messages encrypted: =1, not-encrypted =0, client replies with HandshakeResult
+// handshake message 2 (optional): one byte per CipherSuite of the server, client replies with HandshakeResult + chosen CipherSuite
+// handshake message 3 (optional): exchange encryption keys (and encrypt anything that goes over the wire afterward)
+// handshake message 4: byte0-4 = server's possible MaxMsgSize size as uint32 in big endian, client replies with HandshakeResult
+// the handshake only uses the given (not yet accepted) connection, so handshakes with several connecting clients can run concurrently.
+// returns the encryption.Session of the connection (nil if not encrypted).
+func (s *Server) serverHandshake(conn net.Conn, log *slog.Logger) (*encryption.Session, error) {
+	err := conn.SetDeadline(time.Now().Add(s.conf.HandshakeTimeout))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	err = s.serverSendAndReceiveHandshake1(conn, log)
+	if err != nil {
+		return nil, err
 	}
 
+	var session *encryption.Session
 	if s.conf.Encryption {
-		err = s.serverExchangeEncryptionKeysAndCreateCipher()
+		suite, err := s.serverNegotiateCipherSuite(conn, log)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		session, err = s.serverExchangeEncryptionKeysAndCreateCipher(conn, suite, log)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	err = s.serverSendMaxMsgSizeConstraint()
+	err = s.serverSendMaxMsgSizeConstraint(conn, session, log)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Debugln("server handshake: successful.")
-	return nil
+	log.Debug("handshake: successful")
+	return session, nil
 }
 
-func (s *Server) serverSendAndReceiveHandshake1() error {
+func (s *Server) serverSendAndReceiveHandshake1(conn net.Conn, log *slog.Logger) error {
 	buff := make([]byte, 2)
 	buff[0] = byte(ipcVersion)
 
@@ -45,138 +66,165 @@ func (s *Server) serverSendAndReceiveHandshake1() error {
 		buff[1] = byte(Plain)
 	}
 
-	_, err := s.conn.Write(buff)
+	err := writeHandshakeMessage(conn, buff)
 	if err != nil {
-		return errors.New("server handshake1: unable to send handshake1")
+		return errors.New("server handshake1: unable to send handshake1: " + err.Error())
 	} else {
-		log.Debugf("server handshake1: sent handshake to client:  (version/encryption): (%d/%d)", ipcVersion, buff[1])
+		log.Debug("handshake1: sent handshake to client", "version", ipcVersion, "encryption", buff[1])
 	}
 
-	recv := make([]byte, 1)
-	_, err = s.conn.Read(recv)
+	recv, err := readHandshakeMessage(conn, 1)
 	if err != nil {
-		return errors.New("server handshake1: failed to received handshake1 reply")
+		return errors.New("server handshake1: failed to received handshake1 reply: " + err.Error())
 	} else {
 		if recv[0] == 0 {
-			log.Debugln("server handshake1: received handshake1 from client: ok")
+			log.Debug("handshake1: received handshake1 from client: ok")
 		} else {
-			log.Debugf("server handshake1: received handshake1 from client error: %d", recv[0])
+			log.Debug("handshake1: received handshake1 from client: error", "result", HandshakeResult(recv[0]))
 		}
 	}
 
-	switch result := recv[0]; result {
-	case 0:
+	switch result := HandshakeResult(recv[0]); result {
+	case HandshakeOk:
 		return nil
-	case 1:
-		return errors.New("server handshake1: client has a different version number")
-	case 2:
-		return errors.New("server handshake1: client is enforcing encryption")
-	case 3:
-		return errors.New("server handshake1: failed to get handshake reply")
+	case IpcVersionMismatch:
+		return &handshakeError{result, "server handshake1: client has a different version number"}
+	case ClientEncryptedServerNot:
+		return &handshakeError{result, "server handshake1: client is enforcing encryption"}
 	default:
 		return errors.New("server handshake1: other error - handshake failed")
 	}
 }
 
-func (s *Server) serverExchangeEncryptionKeysAndCreateCipher() error {
-	ownPrivateKey, peerPublicKey, err := s.serverKeyExchange()
+func (s *Server) serverNegotiateCipherSuite(conn net.Conn, log *slog.Logger) (CipherSuite, error) {
+	buff := make([]byte, 0, len(s.conf.CipherSuites))
+	for _, suite := range s.conf.CipherSuites {
+		buff = append(buff, byte(suite))
+	}
+
+	err := writeHandshakeMessage(conn, buff)
 	if err != nil {
-		return err
+		return 0, errors.New("server handshake: unable to send cipher suites: " + err.Error())
+	} else {
+		log.Debug("handshake: sent cipher suites to client", "cipher_suites", s.conf.CipherSuites)
 	}
 
-	sharedSecret, err := sharedSecretX25519(ownPrivateKey.Bytes(), peerPublicKey.Bytes())
+	reply, err := readHandshakeMessage(conn, 2)
 	if err != nil {
-		return err
+		return 0, errors.New("server handshake: failed to receive chosen cipher suite: " + err.Error())
+	}
+
+	if HandshakeResult(reply[0]) == NoCommonCipherSuite {
+		return 0, &handshakeError{NoCommonCipherSuite, "server handshake: client supports none of the server's cipher suites"}
+	}
+	suite := CipherSuite(reply[1])
+	if HandshakeResult(reply[0]) != HandshakeOk || !containsCipherSuite(s.conf.CipherSuites, suite) {
+		return 0, errors.New(fmt.Sprintf("server handshake: client chose unsupported cipher suite %d", reply[1]))
 	}
-	aeadCipher, err := createGcmCipherFromX25519SharedKey(sharedSecret)
+
+	log.Debug("handshake: client chose cipher suite", "cipher_suite", suite)
+	return suite, nil
+}
+
+func (s *Server) serverExchangeEncryptionKeysAndCreateCipher(conn net.Conn, suite CipherSuite, log *slog.Logger) (*encryption.Session, error) {
+	ownPrivateKey, peerPublicKey, err := serverKeyExchange(conn, log)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s.cipher = aeadCipher
-	return nil
+	return encryption.NewSession(suite, ownPrivateKey, peerPublicKey.Bytes())
 }
 
-func (s *Server) serverSendMaxMsgSizeConstraint() error {
+func (s *Server) serverSendMaxMsgSizeConstraint(conn net.Conn, session *encryption.Session, log *slog.Logger) error {
 	toSend := make([]byte, 4)
-	buff := make([]byte, 4)
-	binary.BigEndian.PutUint32(buff, uint32(s.conf.MaxMsgSize))
+	binary.BigEndian.PutUint32(toSend, uint32(s.conf.MaxMsgSize))
 
-	if s.conf.Encryption {
-		encryptedMsg, err := encrypt(s.cipher, buff)
+	if session != nil {
+		encryptedMsg, err := session.Seal(toSend)
 		if err != nil {
 			return err
 		}
-
-		binary.BigEndian.PutUint32(toSend, uint32(len(encryptedMsg)))
-		toSend = append(toSend, encryptedMsg...)
-	} else {
-		binary.BigEndian.PutUint32(toSend, uint32(len(buff)))
-		toSend = append(toSend, buff...)
+		toSend = encryptedMsg
 	}
 
-	_, err := s.conn.Write(toSend)
+	err := writeHandshakeMessage(conn, toSend)
 	if err != nil {
-		return errors.New("server handshake2: unable to send MaxMsgSize constraint")
+		return errors.New("server handshake2: unable to send MaxMsgSize constraint: " + err.Error())
 	} else {
-		log.Debugln("server handshake2: sent server's MaxMsgSize constraint")
+		log.Debug("handshake2: sent server's MaxMsgSize constraint", "max_msg_size", s.conf.MaxMsgSize)
 	}
 
-	reply := make([]byte, 1)
-	_, err = s.conn.Read(reply)
+	reply, err := readHandshakeMessage(conn, 1)
 	if err != nil {
-		return errors.New("server handshake2: did not receive MaxMsgSize constraint reply")
+		return errors.New("server handshake2: did not receive MaxMsgSize constraint reply: " + err.Error())
 	} else {
-		log.Debugln("server handshake2: received client's MaxMsgSize reply")
+		log.Debug("handshake2: received client's MaxMsgSize reply")
 	}
 
+	if HandshakeResult(reply[0]) == ClientMaxMessageLengthTooBig {
+		return &handshakeError{ClientMaxMessageLengthTooBig, "server handshake2: client's MaxMsgSize is bigger than the server's"}
+	} else if HandshakeResult(reply[0]) != HandshakeOk {
+		return errors.New("server handshake2: other error - handshake failed")
+	}
 	return nil
 }
 
 // after the server initiated the handshake
 // (handshake between client and server is done purely over the connection, no go channels involved)
-// handshake message 1: byte 0 = ipcVersion, byte 1 = exchange messages encrypted: =1, not-encrypted =0
-// handshake message 2 (optional): exchange encryption keys (and encrypt anything that goes over the wire afterward)
-// handshake message 3: byte0-4 = server's possible MaxMsgSize size as uint32 in big endian
-func (c *Client) clientDoPassiveHandshake() error {
-	err := c.clientReceiveAndSendHandshake1()
+// handshake message 1: byte 0 = ipcVersion, byte 1 = exchange messages encrypted: =1, not-encrypted =0, client replies with HandshakeResult
+// handshake message 2 (optional): one byte per CipherSuite of the server, client replies with HandshakeResult + chosen CipherSuite
+// handshake message 3 (optional): exchange encryption keys (and encrypt anything that goes over the wire afterward)
+// handshake message 4: byte0-4 = server's possible MaxMsgSize size as uint32 in big endian, client replies with HandshakeResult
+func (c *Client) clientDoPassiveHandshake(log *slog.Logger) error {
+	err := c.conn.SetDeadline(time.Now().Add(c.conf.HandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+
+	err = c.clientReceiveAndSendHandshake1(log)
 	if err != nil {
 		return err
 	}
 
 	if c.conf.Encryption {
-		err := c.clientDoPassiveExchangeEncryptionKeysAndCreateCipher()
+		suite, err := c.clientChooseCipherSuite(log)
 		if err != nil {
 			return err
 		}
+		err = c.clientDoPassiveExchangeEncryptionKeysAndCreateCipher(suite, log)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.crypto.reset(nil, 0, 0, withSubsystem(log, SubsystemCrypto))
 	}
 
-	err = c.clientReceiveMaxMsgSizeConstraint()
+	err = c.clientReceiveMaxMsgSizeConstraint(log)
 	if err != nil {
 		return err
 	}
 
-	log.Debugln("client handshake: successful.")
+	log.Debug("handshake: successful")
 	return nil
 }
 
-func (c *Client) clientReceiveAndSendHandshake1() error {
-	bytesFromServer := make([]byte, 2)
-	_, err := c.conn.Read(bytesFromServer)
+func (c *Client) clientReceiveAndSendHandshake1(log *slog.Logger) error {
+	bytesFromServer, err := readHandshakeMessage(c.conn, 2)
 	if err != nil {
-		return errors.New("client failed to received handshake message")
+		return errors.New("client failed to received handshake message: " + err.Error())
 	} else {
-		log.Debugf("client handshake1: received (version/encryption): (%d/%d)", bytesFromServer[0], bytesFromServer[1])
+		log.Debug("handshake1: received handshake1 from server", "version", bytesFromServer[0], "encryption", bytesFromServer[1])
 	}
 
 	if bytesFromServer[0] != ipcVersion {
 		c.handshakeSendReply(IpcVersionMismatch)
-		return errors.New("client handshake: server has a different ipcVersion number")
+		return &handshakeError{IpcVersionMismatch, "client handshake: server has a different ipcVersion number"}
 	}
 
 	if bytesFromServer[1] == byte(Plain) && c.conf.Encryption {
 		c.handshakeSendReply(ClientEncryptedServerNot)
-		return errors.New("client handshake: server communicates unencrypted/plain, client wants encrypted communication")
+		return &handshakeError{ClientEncryptedServerNot, "client handshake: server communicates unencrypted/plain, client wants encrypted communication"}
 	}
 
 	if bytesFromServer[1] == byte(Plain) {
@@ -185,75 +233,124 @@ func (c *Client) clientReceiveAndSendHandshake1() error {
 		c.conf.Encryption = true
 	}
 
-	log.Debugln("client handshake1: sending handshake1 ok back to to server")
-	c.handshakeSendReply(HandshakeOk) // 0 is ok
-	return nil
+	log.Debug("handshake1: sending handshake1 ok back to server")
+	return c.handshakeSendReply(HandshakeOk) // 0 is ok
 }
 
-func (c *Client) clientDoPassiveExchangeEncryptionKeysAndCreateCipher() error {
-	ownPrivateKey, peerPublicKey, err := c.clientKeyExchange()
+// clientChooseCipherSuite picks the first of the client's CipherSuites (in order of preference) the server also supports
+func (c *Client) clientChooseCipherSuite(log *slog.Logger) (CipherSuite, error) {
+	buff, err := readHandshakeMessage(c.conn, 1)
 	if err != nil {
-		return err
+		return 0, errors.New("client handshake: failed to receive server's cipher suites: " + err.Error())
+	}
+	serverSuites := make([]CipherSuite, 0, len(buff))
+	for _, b := range buff {
+		serverSuites = append(serverSuites, CipherSuite(b))
 	}
 
-	sharedSecret, err := sharedSecretX25519(ownPrivateKey.Bytes(), peerPublicKey.Bytes())
-	if err != nil { return err}
+	for _, suite := range c.conf.CipherSuites {
+		if containsCipherSuite(serverSuites, suite) {
+			log.Debug("handshake: chose cipher suite", "cipher_suite", suite)
+			return suite, writeHandshakeMessage(c.conn, []byte{byte(HandshakeOk), byte(suite)})
+		}
+	}
 
-	aeadCipher, err := createGcmCipherFromX25519SharedKey(sharedSecret)
+	writeHandshakeMessage(c.conn, []byte{byte(NoCommonCipherSuite), 0})
+	return 0, &handshakeError{NoCommonCipherSuite, fmt.Sprintf("client handshake: server supports none of the client's cipher suites (server: %v)", serverSuites)}
+}
+
+func (c *Client) clientDoPassiveExchangeEncryptionKeysAndCreateCipher(suite CipherSuite, log *slog.Logger) error {
+	ownPrivateKey, peerPublicKey, err := c.clientKeyExchange(log)
 	if err != nil {
 		return err
 	}
 
-	c.cipher = aeadCipher
-	return nil
-}
-
-func (c *Client) clientReceiveMaxMsgSizeConstraint() error {
-	bytesFromServer := make([]byte, 4)
-	_, err := c.conn.Read(bytesFromServer)
+	session, err := encryption.NewSession(suite, ownPrivateKey, peerPublicKey.Bytes())
 	if err != nil {
-		return errors.New("client handshake2: failed to receive max message length 1")
+		return err
 	}
 
-	var msgLen uint32
-	binary.Read(bytes.NewReader(bytesFromServer), binary.BigEndian, &msgLen) // message length
+	c.crypto.reset(session, c.conf.RekeyAfterFrames, c.conf.RekeyAfterDuration, withSubsystem(log, SubsystemCrypto))
+	return nil
+}
 
-	bytesFromServer = make([]byte, int(msgLen))
-	_, err = c.conn.Read(bytesFromServer)
+func (c *Client) clientReceiveMaxMsgSizeConstraint(log *slog.Logger) error {
+	bytesFromServer, err := readHandshakeMessage(c.conn, 4)
 	if err != nil {
-		return errors.New("client handshake2: failed to receive max message length 2")
+		return errors.New("client handshake2: failed to receive max message length: " + err.Error())
 	}
-	var buff2 []byte
+
 	if c.conf.Encryption {
-		buff2, err = decrypt(c.cipher, bytesFromServer)
-		if err != nil {
-			return errors.New("client handshake2: failed to receive max message length 3")
+		bytesFromServer, err = c.crypto.open(bytesFromServer)
+		if err != nil || len(bytesFromServer) != 4 {
+			return errors.New("client handshake2: failed to decrypt max message length")
 		}
-	} else {
-		buff2 = bytesFromServer
 	}
 
-	var maxMsgSize uint32
-	binary.Read(bytes.NewReader(buff2), binary.BigEndian, &maxMsgSize) // message length
+	maxMsgLenOfServer := int(binary.BigEndian.Uint32(bytesFromServer))
 
 	if c.conf.MaxMsgSize > 0 {
-		maxMsgLenOfServer := bytesToInt(bytesFromServer[:2])
 		if maxMsgLenOfServer > 0 && maxMsgLenOfServer < c.conf.MaxMsgSize {
 			c.handshakeSendReply(ClientMaxMessageLengthTooBig)
-			return errors.New(fmt.Sprintf("client handshake2: server only supports message length up to %d", maxMsgLenOfServer))
+			return &handshakeError{ClientMaxMessageLengthTooBig, fmt.Sprintf("client handshake2: server only supports message length up to %d", maxMsgLenOfServer)}
 		}
 	} else {
-		c.conf.MaxMsgSize = int(maxMsgSize)
+		c.conf.MaxMsgSize = maxMsgLenOfServer
 	}
 
-	log.Debugln("client handshake2: sending handshake2 ok with server's maxMsgSize constraint")
-	c.handshakeSendReply(HandshakeOk)
-	return nil
+	log.Debug("handshake2: sending handshake2 ok with server's MaxMsgSize constraint", "max_msg_size", maxMsgLenOfServer)
+	return c.handshakeSendReply(HandshakeOk)
 }
 
-func (c *Client) handshakeSendReply(result HandshakeResult) {
-	buff := make([]byte, 1)
-	buff[0] = byte(result)
+// handshakeError - a handshake failed for a reason both sides know as HandshakeResult
+type handshakeError struct {
+	result HandshakeResult
+	msg    string
+}
 
-	c.conn.Write(buff)
+func (e *handshakeError) Error() string {
+	return e.msg
+}
+
+// handshakeResultOf returns the HandshakeResult a handshake ended with, HandshakeError if err has none (e.g. a timeout)
+func handshakeResultOf(err error) HandshakeResult {
+	if err == nil {
+		return HandshakeOk
+	}
+	var hsErr *handshakeError
+	if errors.As(err, &hsErr) {
+		return hsErr.result
+	}
+	return HandshakeError
+}
+
+func (c *Client) handshakeSendReply(result HandshakeResult) error {
+	return writeHandshakeMessage(c.conn, []byte{byte(result)})
+}
+
+// writeHandshakeMessage writes the length-prefixed handshake message in a single write
+func writeHandshakeMessage(conn net.Conn, msg []byte) error {
+	_, err := conn.Write(append(intToBytes(len(msg)), msg...))
+	return err
+}
+
+// readHandshakeMessage reads a complete length-prefixed handshake message of at least minLen bytes
+func readHandshakeMessage(conn net.Conn, minLen int) ([]byte, error) {
+	bLen := make([]byte, 4)
+	_, err := io.ReadFull(conn, bLen)
+	if err != nil {
+		return nil, err
+	}
+
+	mLen := bytesToInt(bLen)
+	if mLen < minLen || mLen > maxHandshakeMsgSize {
+		return nil, errors.New(fmt.Sprintf("invalid handshake message length %d", mLen))
+	}
+
+	msg := make([]byte, mLen)
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
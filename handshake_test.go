@@ -0,0 +1,245 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// fragmentingTransport - reads return at most one byte, like a stream that delivers its data in small pieces
+type fragmentingTransport struct {
+	Transport
+}
+
+func (t fragmentingTransport) Listen(name string) (net.Listener, error) {
+	l, err := t.Transport.Listen(name)
+	if err != nil {
+		return nil, err
+	}
+	return fragmentingListener{l}, nil
+}
+
+func (t fragmentingTransport) Dial(ctx context.Context, name string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return fragmentingConn{conn}, nil
+}
+
+type fragmentingListener struct {
+	net.Listener
+}
+
+func (l fragmentingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return fragmentingConn{conn}, nil
+}
+
+type fragmentingConn struct {
+	net.Conn
+}
+
+func (c fragmentingConn) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Read(p)
+}
+
+func TestCipherSuiteNegotiationWithShortReads(t *testing.T) {
+	transport := fragmentingTransport{NewMemoryTransport()}
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: true, CipherSuites: []CipherSuite{AES256GCM, ChaCha20Poly1305}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: true, CipherSuites: []CipherSuite{ChaCha20Poly1305, AES256GCM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if suite := c.crypto.session.Suite(); suite != ChaCha20Poly1305 {
+		t.Errorf("client uses %s, expected its preferred %s", suite, ChaCha20Poly1305)
+	}
+	mustExchange(t, 10, c.Send, s.Receive)
+	mustExchange(t, 10, s.Send, c.Receive)
+}
+
+func TestCipherSuiteNegotiationWithoutCommonSuite(t *testing.T) {
+	transport := NewMemoryTransport()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: true, CipherSuites: []CipherSuite{AES256GCM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	handshakes := make(chan HandshakeResult, 1)
+	_, err = ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: true, CipherSuites: []CipherSuite{ChaCha20Poly1305},
+		Metrics: handshakeMetrics{results: handshakes}})
+	if err == nil {
+		t.Fatal("client connected without a common cipher suite")
+	}
+	var hsErr *handshakeError
+	if !errors.As(err, &hsErr) || hsErr.result != NoCommonCipherSuite {
+		t.Errorf("client failed with %v, expected the handshake error %s", err, NoCommonCipherSuite)
+	}
+	if result := <-handshakes; result != NoCommonCipherSuite {
+		t.Errorf("handshake failed with %s, expected %s", result, NoCommonCipherSuite)
+	}
+}
+
+// handshakeMetrics - Metrics reporting the results of failed handshakes
+type handshakeMetrics struct {
+	noMetrics
+	results chan<- HandshakeResult
+}
+
+func (m handshakeMetrics) Handshake(result HandshakeResult, err error) {
+	if err != nil {
+		m.results <- result
+	}
+}
+
+func TestHandshakeWithShortReads(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		transport := fragmentingTransport{NewMemoryTransport()}
+		s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: encryption})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: encryption, Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatalf("encryption %v: %v", encryption, err)
+		}
+		mustExchange(t, 10, c.Send, s.Receive)
+		mustExchange(t, 10, s.Send, c.Receive)
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestReadHandshakeMessage(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		valid bool
+	}{
+		{"complete", append(intToBytes(3), 1, 2, 3), true},
+		{"too short", append(intToBytes(1), 1), false},
+		{"too long", intToBytes(maxHandshakeMsgSize + 1), false},
+		{"truncated", append(intToBytes(3), 1, 2), false},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			fragmentingWrite(client, test.frame)
+			client.Close()
+		}()
+		msg, err := readHandshakeMessage(server, 2)
+		if test.valid && (err != nil || len(msg) != 3) {
+			t.Errorf("%s: read %v, %v", test.name, msg, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: read %v", test.name, msg)
+		}
+		server.Close()
+	}
+}
+
+// fragmentingWrite writes data one byte at a time
+func fragmentingWrite(conn net.Conn, data []byte) {
+	for i := range data {
+		if _, err := conn.Write(data[i : i+1]); err != nil {
+			return
+		}
+	}
+}
+
+func TestSilentClientHitsHandshakeTimeout(t *testing.T) {
+	transport := NewMemoryTransport()
+	handshakes := make(chan HandshakeResult, 1)
+	s, err := StartServer("test", &ServerConfig{Transport: transport, HandshakeTimeout: 50 * time.Millisecond, Metrics: handshakeMetrics{results: handshakes}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := transport.Dial(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case result := <-handshakes:
+		if result != HandshakeError {
+			t.Errorf("the timed out handshake reported %s, expected %s", result, HandshakeError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake with a silent client didn't time out")
+	}
+	if s.Status() != SListening {
+		t.Errorf("server is %s after the handshake timed out", s.Status())
+	}
+}
+
+func TestPendingHandshakesLimit(t *testing.T) {
+	transport := NewMemoryTransport()
+	handshakes := make(chan HandshakeResult, 4)
+	s, err := StartServer("test", &ServerConfig{Transport: transport, HandshakeTimeout: 500 * time.Millisecond, MaxPendingHandshakes: 2,
+		Metrics: handshakeMetrics{results: handshakes}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a silent client doesn't keep others from connecting
+	silent, err := transport.Dial(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExchange(t, 1, c.Send, s.Receive)
+	c.Close()
+	waitFor(t, "client disconnected", func() bool { return s.Status() == SDisconnected })
+
+	// while MaxPendingHandshakes silent clients are pending, further clients are rejected right away
+	silent2, err := transport.Dial(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent2.Close()
+	waitFor(t, "pending handshakes", func() bool { return len(s.pendingHandshakes) == 2 })
+	rejected, err := transport.Dial(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("rejected client read %v, expected a closed connection", err)
+	}
+	rejected.Close()
+
+	// once they timed out, clients connect again
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handshakes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending handshakes didn't time out")
+		}
+	}
+	c, err = ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExchange(t, 1, c.Send, s.Receive)
+	c.Close()
+}
@@ -3,6 +3,8 @@ package ipc
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 func (mt MsgType) toBytes() []byte {
@@ -15,7 +17,7 @@ func intToBytes(mLen int) []byte {
 }
 
 func bytesToMsgType(b []byte) MsgType {
-	return MsgType(bytesToInt(b))
+	return MsgType(int32(bytesToInt(b))) // internal MsgTypes are negative
 }
 func bytesToIpcMsgType(b []byte) IpcMsgType {
 	return IpcMsgType(bytesToInt(b))
@@ -25,3 +27,82 @@ func bytesToInt(b []byte) int {
 	binary.Read(bytes.NewReader(b[:]), binary.BigEndian, &mlen) // message length
 	return int(mlen)
 }
+
+// messageWithHeaders frames carry the Headers of a message:
+// byte0-4 = MsgType of the message, byte4-6 = number of headers, then per header: key length (2 bytes), key, value length (2 bytes), value,
+// followed by the message data. All numbers are big endian.
+const maxHeaderLen = 0xffff
+
+func validateHeaders(headers map[string]string) error {
+	if len(headers) > maxHeaderLen {
+		return errors.New(fmt.Sprintf("a message can't have more than %d headers", maxHeaderLen))
+	}
+	for key, value := range headers {
+		if len(key) > maxHeaderLen || len(value) > maxHeaderLen {
+			return errors.New(fmt.Sprintf("header %.32q exceeds the maximum length of %d bytes", key, maxHeaderLen))
+		}
+	}
+	return nil
+}
+
+func encodeMessageWithHeaders(msgType MsgType, headers map[string]string, data []byte) []byte {
+	size := 6 + len(data)
+	for key, value := range headers {
+		size += 4 + len(key) + len(value)
+	}
+	buff := make([]byte, 6, size)
+	binary.BigEndian.PutUint32(buff[:4], uint32(msgType))
+	binary.BigEndian.PutUint16(buff[4:6], uint16(len(headers)))
+	for key, value := range headers {
+		buff = binary.BigEndian.AppendUint16(buff, uint16(len(key)))
+		buff = append(buff, key...)
+		buff = binary.BigEndian.AppendUint16(buff, uint16(len(value)))
+		buff = append(buff, value...)
+	}
+	return append(buff, data...)
+}
+
+func decodeMessageWithHeaders(data []byte) (*Message, error) {
+	errTooShort := errors.New("message with headers is too short")
+	if len(data) < 6 {
+		return nil, errTooShort
+	}
+	msgType := bytesToMsgType(data[:4])
+	count := int(binary.BigEndian.Uint16(data[4:6]))
+	data = data[6:]
+
+	headers := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		var key, value string
+		for _, s := range []*string{&key, &value} {
+			if len(data) < 2 {
+				return nil, errTooShort
+			}
+			n := int(binary.BigEndian.Uint16(data[:2]))
+			if len(data) < 2+n {
+				return nil, errTooShort
+			}
+			*s = string(data[2 : 2+n])
+			data = data[2+n:]
+		}
+		headers[key] = value
+	}
+	if msgType <= 0 {
+		return nil, errors.New(fmt.Sprintf("message with headers has the reserved type %d", msgType))
+	}
+
+	msg := NewMessage(msgType, data)
+	msg.Headers = headers
+	return msg, nil
+}
+
+// newReceivedMessage turns the MsgType and data of a received frame (or of the message inside a messageWithFiles frame) into a Message
+func newReceivedMessage(msgType MsgType, data []byte) (*Message, error) {
+	if msgType == messageWithHeaders {
+		return decodeMessageWithHeaders(data)
+	}
+	if msgType <= 0 {
+		return nil, errors.New(fmt.Sprintf("received message has the reserved type %d", msgType))
+	}
+	return NewMessage(msgType, data), nil
+}
@@ -0,0 +1,89 @@
+package ipc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Direction - whether an Interceptor is called with a message being sent or received
+type Direction int
+
+const (
+	Outbound Direction = iota // passed to Send (or SendFDs, Session.Send), not queued yet
+	Inbound                   // received, about to be returned by Receive
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "Outbound"
+	case Inbound:
+		return "Inbound"
+	default:
+		return "<Unknown>"
+	}
+}
+
+// Interceptor - called with each message sent or received (see Use). It may inspect or modify msg and pass it on by calling next
+// (possibly with another message), reject it by returning an error, or swallow it by returning nil without calling next.
+//
+// A rejected outbound message makes Send return the error, a rejected inbound one makes Receive return it.
+// Swallowed outbound messages are not sent (Send returns nil), swallowed inbound ones are skipped by Receive.
+type Interceptor func(direction Direction, msg *Message, next func(*Message) error) error
+
+// interceptors - the chain of Interceptors of a Server or Client, in the order they were added
+type interceptors struct {
+	mutex sync.Mutex // serializes use
+	chain atomic.Pointer[[]Interceptor]
+}
+
+func (i *interceptors) use(interceptor Interceptor) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var chain []Interceptor
+	if current := i.chain.Load(); current != nil {
+		chain = append(chain, *current...)
+	}
+	chain = append(chain, interceptor)
+	i.chain.Store(&chain)
+}
+
+// run passes msg through the chain, the last interceptor's next is final.
+// The files of a message that doesn't reach final are closed.
+func (i *interceptors) run(direction Direction, msg *Message, final func(*Message) error) error {
+	chain := i.chain.Load()
+	if chain == nil {
+		return final(msg)
+	}
+
+	reached := false
+	var next func(int, *Message) error
+	next = func(n int, m *Message) error {
+		if n == len(*chain) {
+			reached = true
+			return final(m)
+		}
+		return (*chain)[n](direction, m, func(m *Message) error { return next(n+1, m) })
+	}
+	err := next(0, msg)
+	if !reached {
+		closeFiles(msg.Files)
+	}
+	return err
+}
+
+// receive passes a received msg through the chain, nil (without an error) if it has been swallowed
+func (i *interceptors) receive(msg *Message) (*Message, error) {
+	var received *Message
+	err := i.run(Inbound, msg, func(m *Message) error {
+		received = m
+		if received.sessionID == 0 {
+			received.sessionID = msg.sessionID // replaced by an interceptor, still from the same client
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return received, nil
+}
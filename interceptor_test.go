@@ -0,0 +1,79 @@
+package ipc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestInterceptorChainOrder(t *testing.T) {
+	var i interceptors
+	var calls []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		i.use(func(direction Direction, msg *Message, next func(*Message) error) error {
+			calls = append(calls, name+" "+direction.String())
+			return next(msg)
+		})
+	}
+	i.run(Outbound, NewMessage(Custom, nil), func(*Message) error {
+		calls = append(calls, "final")
+		return nil
+	})
+	if len(calls) != 3 || calls[0] != "first Outbound" || calls[1] != "second Outbound" || calls[2] != "final" {
+		t.Errorf("calls %v", calls)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	s, c := startMemoryPair(t, NewMemoryTransport(), false)
+	defer s.Close()
+	defer c.Close()
+
+	errNoTenant := errors.New("no tenant")
+	c.Use(func(direction Direction, msg *Message, next func(*Message) error) error {
+		if direction == Outbound && msg.MsgType == String {
+			msg.Data = append([]byte("tenant-a:"), msg.Data...) // tag
+		}
+		return next(msg)
+	})
+	s.Use(func(direction Direction, msg *Message, next func(*Message) error) error {
+		if direction == Inbound {
+			tenant, data, found := bytes.Cut(msg.Data, []byte(":"))
+			if !found {
+				return errNoTenant // reject
+			}
+			if string(tenant) == "tenant-b" {
+				return nil // swallow
+			}
+			msg.Data = data
+		}
+		return next(msg)
+	})
+	s.Use(func(direction Direction, msg *Message, next func(*Message) error) error {
+		if direction == Outbound && string(msg.Data) == "secret" {
+			return errors.New("must not be sent")
+		}
+		return next(NewMessage(msg.MsgType, bytes.ToUpper(msg.Data))) // replace
+	})
+
+	c.Send(Custom, []byte("untagged"))
+	if _, err := s.Receive(); !errors.Is(err, errNoTenant) {
+		t.Fatalf("server received %v, expected the rejection", err)
+	}
+
+	c.Send(Custom, []byte("tenant-b:skipped"))
+	c.Send(String, []byte("hello"))
+	m, err := s.Receive()
+	if err != nil || string(m.Data) != "HELLO" {
+		t.Fatalf("server received %v, %v", m, err)
+	}
+
+	if err := s.Send(String, []byte("secret")); err == nil {
+		t.Error("Send of a rejected message must fail")
+	}
+	s.Send(String, []byte("reply"))
+	if m, err := c.Receive(); err != nil || string(m.Data) != "REPLY" {
+		t.Fatalf("client received %v, %v", m, err)
+	}
+}
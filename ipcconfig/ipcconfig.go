@@ -1,5 +1,35 @@
+// Package ipcconfig - settings of the ipc library read from the environment
 package ipcconfig
 
+import (
+	"os"
+	"strings"
+)
+
+// DebugEnv - the environment variable turning on debug logging when a server or client is created:
+// "1", "true" or "all" for everything, or a comma separated list of subsystems, e.g. "handshake,reconnect"
+const DebugEnv = "GOLANG_IPC_DEBUG"
+
 const (
+	// Deprecated: debug logging is configured at runtime, see DebugEnv and ipc.LogLevels. The ipc library doesn't use it anymore.
 	IpcDebugLogging = true
 )
+
+// DebugSubsystems - parses DebugEnv: all is true if debug logging is on for everything, otherwise subsystems lists
+// the subsystems to debug (none if DebugEnv is unset, empty, "0" or "false")
+func DebugSubsystems() (all bool, subsystems []string) {
+	value := strings.TrimSpace(os.Getenv(DebugEnv))
+	switch strings.ToLower(value) {
+	case "", "0", "false":
+		return false, nil
+	case "1", "true", "all", "*":
+		return true, nil
+	}
+	for _, subsystem := range strings.Split(value, ",") {
+		subsystem = strings.ToLower(strings.TrimSpace(subsystem))
+		if subsystem != "" {
+			subsystems = append(subsystems, subsystem)
+		}
+	}
+	return false, subsystems
+}
@@ -1,3 +1,7 @@
+// Package ipclogging - the logging of earlier versions, writing to the global log package.
+//
+// Deprecated: the ipc library doesn't use it anymore, servers and clients log to the *slog.Logger
+// of their config (ServerConfig.Logger, ClientConfig.Logger). Its Fatal functions exit the process.
 package ipclogging
 
 import (
@@ -6,10 +10,15 @@ import (
 )
 
 var (
-	DoDebug   = ipcconfig.IpcDebugLogging
+	DoDebug   = debugFromEnv() // see ipcconfig.DebugEnv
 	DoLogging = true
 )
 
+func debugFromEnv() bool {
+	all, subsystems := ipcconfig.DebugSubsystems()
+	return all || len(subsystems) > 0
+}
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 }
@@ -0,0 +1,252 @@
+// Package ipcmetrics - collects the ipc.Metrics of servers and clients and exports them in the Prometheus text format
+package ipcmetrics
+
+import (
+	"bytes"
+	"fmt"
+	ipc "github.com/hoffigolang/golang-ipc"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBounds - upper bounds (in seconds) of the send latency histogram
+var latencyBounds = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Registry - the Metrics of any number of servers and clients, an http.Handler serving them in the Prometheus text format:
+//
+//	registry := ipcmetrics.NewRegistry()
+//	s, err := ipc.StartServer("example", &ipc.ServerConfig{Metrics: registry.Metrics("server", "example")})
+//	...
+//	http.Handle("/metrics", registry)
+//	go http.ListenAndServe("127.0.0.1:9090", nil)
+type Registry struct {
+	mutex     sync.Mutex
+	instances map[instanceKey]*Metrics
+}
+
+type instanceKey struct {
+	role string
+	name string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{instances: make(map[instanceKey]*Metrics)}
+}
+
+// Metrics - returns the ipc.Metrics of one server or client, its series are labelled with role (e.g. "server") and name.
+// Asking again for the same role and name returns the same Metrics.
+func (r *Registry) Metrics(role string, name string) *Metrics {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := instanceKey{role, name}
+	m, ok := r.instances[key]
+	if !ok {
+		m = &Metrics{
+			labels:         fmt.Sprintf("role=%s,name=%s", quote(role), quote(name)),
+			sent:           make(map[ipc.MsgType]*traffic),
+			received:       make(map[ipc.MsgType]*traffic),
+			handshakes:     make(map[string]uint64),
+			latencyBuckets: make([]uint64, len(latencyBounds)),
+		}
+		r.instances[key] = m
+	}
+	return m
+}
+
+// ServeHTTP - writes all metrics in the Prometheus text exposition format (version 0.0.4)
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo - writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	instances := make([]*Metrics, 0, len(r.instances))
+	for _, m := range r.instances {
+		instances = append(instances, m)
+	}
+	r.mutex.Unlock()
+	sort.Slice(instances, func(i, j int) bool { return instances[i].labels < instances[j].labels })
+
+	var out bytes.Buffer
+	for _, family := range families {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, m := range instances {
+			m.mutex.Lock()
+			family.write(&out, family.name, m)
+			m.mutex.Unlock()
+		}
+	}
+	n, err := w.Write(out.Bytes())
+	return int64(n), err
+}
+
+// Metrics - the ipc.Metrics of one server or client, see Registry.Metrics
+type Metrics struct {
+	labels string
+
+	mutex          sync.Mutex
+	sent           map[ipc.MsgType]*traffic
+	received       map[ipc.MsgType]*traffic
+	handshakes     map[string]uint64 // by result
+	reconnects     uint64
+	encryptionErrs uint64
+	incomingDepth  int
+	outgoingDepth  int
+	latencyBuckets []uint64 // not cumulative, see latencyBounds
+	latencyCount   uint64
+	latencySum     float64
+}
+
+type traffic struct {
+	messages uint64
+	bytes    uint64
+}
+
+var _ ipc.Metrics = (*Metrics)(nil)
+
+func (m *Metrics) MessageSent(msgType ipc.MsgType, bytes int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count(m.sent, msgType, bytes)
+}
+
+func (m *Metrics) MessageReceived(msgType ipc.MsgType, bytes int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count(m.received, msgType, bytes)
+}
+
+func count(byType map[ipc.MsgType]*traffic, msgType ipc.MsgType, bytes int) {
+	t, ok := byType[msgType]
+	if !ok {
+		t = &traffic{}
+		byType[msgType] = t
+	}
+	t.messages++
+	t.bytes += uint64(bytes)
+}
+
+func (m *Metrics) Handshake(result ipc.HandshakeResult, err error) {
+	label := "ok"
+	if err != nil {
+		label = "error"
+		if result != ipc.HandshakeOk && result != ipc.HandshakeError {
+			label = result.String()
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handshakes[label]++
+}
+
+func (m *Metrics) Reconnect() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reconnects++
+}
+
+func (m *Metrics) EncryptionError() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.encryptionErrs++
+}
+
+func (m *Metrics) QueueDepth(direction ipc.Direction, depth int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if direction == ipc.Inbound {
+		m.incomingDepth = depth
+	} else {
+		m.outgoingDepth = depth
+	}
+}
+
+func (m *Metrics) SendLatency(latency time.Duration) {
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(latencyBounds, seconds) // the first bound >= seconds
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if bucket < len(m.latencyBuckets) {
+		m.latencyBuckets[bucket]++
+	}
+	m.latencyCount++
+	m.latencySum += seconds
+}
+
+// family - one metric of the exposition, write is called with each Metrics' mutex held
+type family struct {
+	name  string
+	help  string
+	kind  string
+	write func(out *bytes.Buffer, name string, m *Metrics)
+}
+
+var families = []family{
+	{"ipc_messages_sent_total", "Messages written to the connection.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		writeTraffic(out, name, m, m.sent, func(t *traffic) uint64 { return t.messages })
+	}},
+	{"ipc_sent_bytes_total", "Message data bytes written to the connection.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		writeTraffic(out, name, m, m.sent, func(t *traffic) uint64 { return t.bytes })
+	}},
+	{"ipc_messages_received_total", "Messages read from the connection.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		writeTraffic(out, name, m, m.received, func(t *traffic) uint64 { return t.messages })
+	}},
+	{"ipc_received_bytes_total", "Message data bytes read from the connection.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		writeTraffic(out, name, m, m.received, func(t *traffic) uint64 { return t.bytes })
+	}},
+	{"ipc_handshakes_total", "Finished handshakes by result.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		results := make([]string, 0, len(m.handshakes))
+		for result := range m.handshakes {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			fmt.Fprintf(out, "%s{%s,result=%s} %d\n", name, m.labels, quote(result), m.handshakes[result])
+		}
+	}},
+	{"ipc_reconnects_total", "Times the client connected again after losing its connection.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, m.labels, m.reconnects)
+	}},
+	{"ipc_encryption_errors_total", "Received frames that could not be decrypted.", "counter", func(out *bytes.Buffer, name string, m *Metrics) {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, m.labels, m.encryptionErrs)
+	}},
+	{"ipc_queue_depth", "Messages waiting in the incoming and outgoing queue.", "gauge", func(out *bytes.Buffer, name string, m *Metrics) {
+		fmt.Fprintf(out, "%s{%s,queue=\"incoming\"} %d\n", name, m.labels, m.incomingDepth)
+		fmt.Fprintf(out, "%s{%s,queue=\"outgoing\"} %d\n", name, m.labels, m.outgoingDepth)
+	}},
+	{"ipc_send_latency_seconds", "Time from Send until the message was written to the connection.", "histogram", func(out *bytes.Buffer, name string, m *Metrics) {
+		var cumulative uint64
+		for i, bound := range latencyBounds {
+			cumulative += m.latencyBuckets[i]
+			fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, m.labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, m.labels, m.latencyCount)
+		fmt.Fprintf(out, "%s_sum{%s} %s\n", name, m.labels, strconv.FormatFloat(m.latencySum, 'g', -1, 64))
+		fmt.Fprintf(out, "%s_count{%s} %d\n", name, m.labels, m.latencyCount)
+	}},
+}
+
+// writeTraffic writes one series per MsgType, labelled with the MsgType's number (custom MsgTypes have no name)
+func writeTraffic(out *bytes.Buffer, name string, m *Metrics, byType map[ipc.MsgType]*traffic, value func(*traffic) uint64) {
+	msgTypes := make([]ipc.MsgType, 0, len(byType))
+	for msgType := range byType {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Slice(msgTypes, func(i, j int) bool { return msgTypes[i] < msgTypes[j] })
+	for _, msgType := range msgTypes {
+		fmt.Fprintf(out, "%s{%s,msg_type=\"%d\"} %d\n", name, m.labels, msgType, value(byType[msgType]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(labelValue string) string {
+	return `"` + labelEscaper.Replace(labelValue) + `"`
+}
@@ -0,0 +1,127 @@
+package ipcmetrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	ipc "github.com/hoffigolang/golang-ipc"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryExportsTraffic(t *testing.T) {
+	registry := NewRegistry()
+	transport := ipc.NewMemoryTransport()
+	s, err := ipc.StartServer("metrics", &ipc.ServerConfig{Transport: transport, Encryption: true, Metrics: registry.Metrics("server", "metrics")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := ipc.ClientDialAndHandshake("metrics", &ipc.ClientConfig{Transport: transport, Encryption: true, Metrics: registry.Metrics("client", "metrics")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := c.Send(ipc.String, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		"# TYPE ipc_messages_sent_total counter\n",
+		`ipc_messages_sent_total{role="client",name="metrics",msg_type="2"} 3` + "\n",
+		`ipc_sent_bytes_total{role="client",name="metrics",msg_type="2"} 15` + "\n",
+		`ipc_messages_received_total{role="server",name="metrics",msg_type="2"} 3` + "\n",
+		`ipc_handshakes_total{role="client",name="metrics",result="ok"} 1` + "\n",
+		`ipc_handshakes_total{role="server",name="metrics",result="ok"} 1` + "\n",
+		`ipc_queue_depth{role="server",name="metrics",queue="incoming"} 0` + "\n",
+		`ipc_send_latency_seconds_count{role="client",name="metrics"} 3` + "\n",
+		`ipc_send_latency_seconds_bucket{role="client",name="metrics",le="+Inf"} 3` + "\n",
+	}
+	deadline := time.Now().Add(10 * time.Second) // the client's writer reports a message after the server might have received it
+	for {
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		exposition := recorder.Body.String()
+		missing := ""
+		for _, line := range expected {
+			if !strings.Contains(exposition, line) {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in\n%s", missing, exposition)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMetricsLabelsAndHistogram(t *testing.T) {
+	registry := NewRegistry()
+	m := registry.Metrics("client", "with \"quotes\"")
+	if registry.Metrics("client", "with \"quotes\"") != m {
+		t.Error("same role and name must return the same Metrics")
+	}
+	m.Handshake(ipc.IpcVersionMismatch, errors.New("version mismatch"))
+	m.Handshake(ipc.HandshakeError, errors.New("timeout"))
+	m.SendLatency(75 * time.Microsecond)
+	m.SendLatency(2 * time.Second)
+
+	var out bytes.Buffer
+	registry.WriteTo(&out)
+	for _, expected := range []string{
+		`ipc_handshakes_total{role="client",name="with \"quotes\"",result="IpcVersionMismatch"} 1`,
+		`ipc_handshakes_total{role="client",name="with \"quotes\"",result="error"} 1`,
+		`ipc_send_latency_seconds_bucket{role="client",name="with \"quotes\"",le="5e-05"} 0`,
+		`ipc_send_latency_seconds_bucket{role="client",name="with \"quotes\"",le="0.0001"} 1`,
+		`ipc_send_latency_seconds_bucket{role="client",name="with \"quotes\"",le="1"} 1`,
+		`ipc_send_latency_seconds_bucket{role="client",name="with \"quotes\"",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(out.String(), expected+"\n") {
+			t.Errorf("missing %q in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestRegistryCountsTimedOutHandshakes(t *testing.T) {
+	registry := NewRegistry()
+	transport := ipc.NewMemoryTransport()
+	s, err := ipc.StartServer("metrics", &ipc.ServerConfig{Transport: transport, HandshakeTimeout: 20 * time.Millisecond, Metrics: registry.Metrics("server", "metrics")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	silent, err := transport.Dial(context.Background(), "metrics") // never answers the handshake
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	expected := `ipc_handshakes_total{role="server",name="metrics",result="error"} 1` + "\n"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var out bytes.Buffer
+		registry.WriteTo(&out)
+		if strings.Contains(out.String(), `result="ok"`) {
+			t.Fatalf("a timed out handshake counted as successful:\n%s", out.String())
+		}
+		if strings.Contains(out.String(), expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in\n%s", expected, out.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
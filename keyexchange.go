@@ -0,0 +1,85 @@
+package ipc
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"github.com/hoffigolang/golang-ipc/encryption"
+	"log/slog"
+	"net"
+)
+
+// serverKeyExchange - get other side's public key
+func serverKeyExchange(conn net.Conn, log *slog.Logger) (*ecdh.PrivateKey, *ecdh.PublicKey, error) {
+	priv, err := encryption.NewX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := priv.PublicKey()
+
+	// send servers public key
+	err = sendPublicKey("server handshake:", conn, pub, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// received clients public key
+	peerPubKey, err := receivePublicKey("server handshake:", conn, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, peerPubKey, nil
+}
+
+func (c *Client) clientKeyExchange(log *slog.Logger) (*ecdh.PrivateKey, *ecdh.PublicKey, error) {
+	priv, err := encryption.NewX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := priv.PublicKey()
+
+	// received servers public key
+	peerPubKey, err := receivePublicKey("client handshake:", c.conn, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// send clients public key
+	err = sendPublicKey("client handshake:", c.conn, pub, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, peerPubKey, nil
+}
+
+func sendPublicKey(who string, conn net.Conn, pub *ecdh.PublicKey, log *slog.Logger) error {
+	pubSend := pub.Bytes()
+	if len(pubSend) == 0 {
+		return errors.New(who + " public key cannot be converted to bytes")
+	}
+
+	err := writeHandshakeMessage(conn, pubSend)
+	if err != nil {
+		return errors.New(who + " could not sent public key: " + err.Error())
+	} else {
+		log.Debug("handshake: sent public key to other side")
+	}
+
+	return nil
+}
+
+func receivePublicKey(who string, conn net.Conn, log *slog.Logger) (*ecdh.PublicKey, error) {
+	buff, err := readHandshakeMessage(conn, 32)
+	if err != nil {
+		return nil, errors.New(who + " didn't received public key: " + err.Error())
+	} else {
+		log.Debug("handshake: received public key")
+	}
+
+	recvdPub, err := ecdh.X25519().NewPublicKey(buff)
+	if err != nil {
+		return nil, errors.New(who + " " + err.Error())
+	}
+	return recvdPub, nil
+}
@@ -0,0 +1,145 @@
+package ipc
+
+import (
+	"context"
+	"github.com/hoffigolang/golang-ipc/ipcconfig"
+	"log/slog"
+	"sync"
+)
+
+// Subsystem - a part of the library whose logs can be filtered on their own (see LogLevels), records carry it as "subsystem" attribute
+type Subsystem string
+
+const (
+	SubsystemHandshake Subsystem = "handshake" // version, cipher suite and key exchange with a connecting peer
+	SubsystemCrypto    Subsystem = "crypto"    // decryption failures and session key rotation
+	SubsystemFraming   Subsystem = "framing"   // reading and writing the frames of a connection
+	SubsystemReconnect Subsystem = "reconnect" // the client dialing the server, retrying and reconnecting
+)
+
+const attributeSubsystem = "subsystem"
+
+// LogLevels - the minimum level of the logs of a Server or Client, overall and per Subsystem (see ServerConfig.LogLevels, ClientConfig.LogLevels).
+// The levels may be changed at any time, also while the server or client is running, and may be shared by several of them.
+type LogLevels struct {
+	level      slog.LevelVar
+	mutex      sync.RWMutex
+	subsystems map[Subsystem]slog.Level
+}
+
+// NewLogLevels - logs of level and above pass, of any subsystem
+func NewLogLevels(level slog.Level) *LogLevels {
+	l := &LogLevels{subsystems: make(map[Subsystem]slog.Level)}
+	l.level.Set(level)
+	return l
+}
+
+// LogLevelsFromEnv - slog.LevelInfo, lowered to slog.LevelDebug as configured in the GOLANG_IPC_DEBUG environment variable:
+// for everything ("1", "true" or "all") or the listed subsystems only (e.g. "handshake,reconnect"). The default of servers and clients.
+func LogLevelsFromEnv() *LogLevels {
+	l := NewLogLevels(slog.LevelInfo)
+	all, subsystems := ipcconfig.DebugSubsystems()
+	if all {
+		l.SetLevel(slog.LevelDebug)
+	}
+	for _, subsystem := range subsystems {
+		l.SetSubsystemLevel(Subsystem(subsystem), slog.LevelDebug)
+	}
+	return l
+}
+
+// Level - the minimum level of logs of subsystems without a level of their own
+func (l *LogLevels) Level() slog.Level {
+	return l.level.Level()
+}
+
+func (l *LogLevels) SetLevel(level slog.Level) {
+	l.level.Set(level)
+}
+
+// SubsystemLevel - the minimum level of the subsystem's logs
+func (l *LogLevels) SubsystemLevel(subsystem Subsystem) slog.Level {
+	l.mutex.RLock()
+	level, ok := l.subsystems[subsystem]
+	l.mutex.RUnlock()
+	if !ok {
+		return l.level.Level()
+	}
+	return level
+}
+
+// SetSubsystemLevel - the subsystem's logs pass from level on, regardless of Level (e.g. slog.LevelDebug for one subsystem only)
+func (l *LogLevels) SetSubsystemLevel(subsystem Subsystem, level slog.Level) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.subsystems[subsystem] = level
+}
+
+// ClearSubsystemLevel - the subsystem's logs follow Level again
+func (l *LogLevels) ClearSubsystemLevel(subsystem Subsystem) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.subsystems, subsystem)
+}
+
+// newLogger returns a logger writing to logger's handler the records LogLevels let pass and the handler is enabled for.
+// LogLevels (and so GOLANG_IPC_DEBUG) only lower the library's own filter, the handler's level still applies.
+func newLogger(logger *slog.Logger, levels *LogLevels) *slog.Logger {
+	return slog.New(&levelFilter{next: logger.Handler(), levels: levels})
+}
+
+// newDefaultLogger returns the logger of a server or client without a configured Logger. It writes to the handler of slog.Default(),
+// but only LogLevels decide: slog's default handler logs Info and above, GOLANG_IPC_DEBUG would have no effect otherwise.
+func newDefaultLogger(levels *LogLevels) *slog.Logger {
+	return slog.New(&levelFilter{next: slog.Default().Handler(), levels: levels, ignoreHandlerLevel: true})
+}
+
+// withSubsystem returns log for the logs of subsystem
+func withSubsystem(log *slog.Logger, subsystem Subsystem) *slog.Logger {
+	return log.With(attributeSubsystem, string(subsystem))
+}
+
+// levelFilter - the slog.Handler of newLogger, it takes the subsystem attribute (see withSubsystem) to pick the level
+type levelFilter struct {
+	next               slog.Handler
+	levels             *LogLevels
+	subsystem          Subsystem
+	ignoreHandlerLevel bool // see newDefaultLogger
+}
+
+func (h *levelFilter) Enabled(ctx context.Context, level slog.Level) bool {
+	minLevel := h.levels.Level()
+	if h.subsystem != "" {
+		minLevel = h.levels.SubsystemLevel(h.subsystem)
+	}
+	return level >= minLevel && (h.ignoreHandlerLevel || h.next.Enabled(ctx, level))
+}
+
+func (h *levelFilter) Handle(ctx context.Context, r slog.Record) error {
+	if h.subsystem != "" {
+		r.AddAttrs(slog.String(attributeSubsystem, string(h.subsystem)))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *levelFilter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	filter := *h
+	others := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.Key == attributeSubsystem {
+			filter.subsystem = Subsystem(attr.Value.String()) // added by Handle, so a record never has two
+		} else {
+			others = append(others, attr)
+		}
+	}
+	if len(others) > 0 {
+		filter.next = h.next.WithAttrs(others)
+	}
+	return &filter
+}
+
+func (h *levelFilter) WithGroup(name string) slog.Handler {
+	filter := *h
+	filter.next = h.next.WithGroup(name)
+	return &filter
+}
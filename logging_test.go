@@ -0,0 +1,153 @@
+package ipc
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogLevelsFilterSubsystems(t *testing.T) {
+	handler := newRecordingHandler()
+	levels := NewLogLevels(slog.LevelInfo)
+	levels.SetSubsystemLevel(SubsystemHandshake, slog.LevelDebug)
+	log := newLogger(slog.New(handler), levels)
+
+	withSubsystem(log, SubsystemHandshake).Debug("handshake debug")
+	withSubsystem(log, SubsystemFraming).Debug("framing debug")
+	log.Debug("debug")
+	log.Info("info")
+	if handler.find("handshake debug", map[string]any{"subsystem": "handshake"}) == nil {
+		t.Error("debug log of a subsystem at debug level is missing")
+	}
+	if handler.find("framing debug", nil) != nil || handler.find("debug", nil) != nil {
+		t.Error("debug logs passed at info level")
+	}
+	if handler.find("info", nil) == nil {
+		t.Error("info log is missing")
+	}
+
+	levels.SetLevel(slog.LevelDebug) // at runtime, for loggers created before
+	levels.ClearSubsystemLevel(SubsystemHandshake)
+	levels.SetSubsystemLevel(SubsystemCrypto, slog.LevelWarn)
+	withSubsystem(withSubsystem(log, SubsystemHandshake), SubsystemFraming).Debug("framing debug")
+	withSubsystem(log, SubsystemCrypto).Info("crypto info")
+	if handler.find("framing debug", map[string]any{"subsystem": "framing"}) == nil {
+		t.Error("debug log is missing after changing the level to debug")
+	}
+	if handler.find("crypto info", nil) != nil {
+		t.Error("info log passed a subsystem at warn level")
+	}
+}
+
+func TestLogLevelsKeepHandlerLevel(t *testing.T) {
+	var buff bytes.Buffer
+	log := newLogger(slog.New(slog.NewTextHandler(&buff, &slog.HandlerOptions{Level: slog.LevelInfo})), NewLogLevels(slog.LevelDebug))
+	withSubsystem(log, SubsystemHandshake).Debug("handshake debug")
+	log.Debug("debug")
+	log.Info("info")
+	if strings.Contains(buff.String(), "debug") {
+		t.Errorf("debug logs passed a handler at info level: %s", buff.String())
+	}
+	if !strings.Contains(buff.String(), "msg=info") {
+		t.Error("info log is missing")
+	}
+}
+
+func TestLogLevelsFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		env       string
+		level     slog.Level
+		handshake slog.Level
+		reconnect slog.Level
+	}{
+		{"", slog.LevelInfo, slog.LevelInfo, slog.LevelInfo},
+		{"0", slog.LevelInfo, slog.LevelInfo, slog.LevelInfo},
+		{"1", slog.LevelDebug, slog.LevelDebug, slog.LevelDebug},
+		{"all", slog.LevelDebug, slog.LevelDebug, slog.LevelDebug},
+		{"handshake", slog.LevelInfo, slog.LevelDebug, slog.LevelInfo},
+		{" Reconnect, framing ", slog.LevelInfo, slog.LevelInfo, slog.LevelDebug},
+	} {
+		t.Setenv("GOLANG_IPC_DEBUG", test.env)
+		levels := LogLevelsFromEnv()
+		if levels.Level() != test.level || levels.SubsystemLevel(SubsystemHandshake) != test.handshake || levels.SubsystemLevel(SubsystemReconnect) != test.reconnect {
+			t.Errorf("GOLANG_IPC_DEBUG=%q: level %s, handshake %s, reconnect %s", test.env, levels.Level(), levels.SubsystemLevel(SubsystemHandshake), levels.SubsystemLevel(SubsystemReconnect))
+		}
+	}
+}
+
+func TestHandshakeDebugLogs(t *testing.T) {
+	t.Setenv("GOLANG_IPC_DEBUG", "handshake")
+	transport := NewMemoryTransport()
+	handler := newRecordingHandler()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Logger: slog.New(handler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Logger: slog.New(handler)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+
+	for _, role := range []string{"server", "client"} {
+		if handler.find("handshake: successful", map[string]any{"ipc": "test", "role": role, "subsystem": "handshake"}) == nil {
+			t.Errorf("%s didn't log its successful handshake", role)
+		}
+	}
+
+	s.LogLevels().SetSubsystemLevel(SubsystemHandshake, slog.LevelInfo)
+	if c.LogLevels().SubsystemLevel(SubsystemHandshake) != slog.LevelDebug {
+		t.Error("server and client share their default LogLevels")
+	}
+}
+
+// lockedBuffer - a bytes.Buffer written by several goroutines
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buff  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buff.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buff.String()
+}
+
+func TestDebugLogsWithDefaultLogger(t *testing.T) {
+	t.Setenv("GOLANG_IPC_DEBUG", "handshake")
+	var output lockedBuffer
+	log.SetOutput(&output) // where the handler of slog.Default() writes to
+	defer log.SetOutput(os.Stderr)
+
+	transport := NewMemoryTransport()
+	s, err := StartServer("test", &ServerConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+
+	if !strings.Contains(output.String(), "DEBUG handshake: successful") {
+		t.Errorf("no handshake debug logs with GOLANG_IPC_DEBUG=handshake: %s", output.String())
+	}
+	if strings.Contains(output.String(), "status changed") {
+		t.Error("debug logs of other subsystems passed")
+	}
+}
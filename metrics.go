@@ -0,0 +1,26 @@
+package ipc
+
+import "time"
+
+// Metrics - receives the measurements of a Server or Client (see ServerConfig.Metrics, ClientConfig.Metrics),
+// e.g. the Prometheus exporter of package ipcmetrics. Implementations must be safe for concurrent use and must not block.
+type Metrics interface {
+	MessageSent(msgType MsgType, bytes int)      // a message (of bytes data) has been written to the connection
+	MessageReceived(msgType MsgType, bytes int)  // a message (of bytes data) has been read from the connection
+	Handshake(result HandshakeResult, err error) // a handshake finished, err is nil if successful. Failures without a HandshakeResult (e.g. timeouts) report HandshakeError
+	Reconnect()                                  // the client connected again after losing its connection
+	EncryptionError()                            // a received frame could not be decrypted
+	QueueDepth(direction Direction, depth int)   // the incoming (Inbound) or outgoing (Outbound) queue has changed to depth messages
+	SendLatency(latency time.Duration)           // a message has been written to the connection latency after Send queued it
+}
+
+// noMetrics - the Metrics of servers and clients configured without
+type noMetrics struct{}
+
+func (noMetrics) MessageSent(MsgType, int)         {}
+func (noMetrics) MessageReceived(MsgType, int)     {}
+func (noMetrics) Handshake(HandshakeResult, error) {}
+func (noMetrics) Reconnect()                       {}
+func (noMetrics) EncryptionError()                 {}
+func (noMetrics) QueueDepth(Direction, int)        {}
+func (noMetrics) SendLatency(time.Duration)        {}
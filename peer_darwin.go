@@ -0,0 +1,29 @@
+//go:build darwin
+// +build darwin
+
+package ipc
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// peerPID returns the process id of the other end of a unix socket connection (0 if unknown, e.g. over TCP)
+func peerPID(conn net.Conn) int {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	pid := 0
+	raw.Control(func(fd uintptr) {
+		pid, err = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+		if err != nil {
+			pid = 0
+		}
+	})
+	return pid
+}
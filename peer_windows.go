@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import "net"
+
+// peerPID - named pipe connections don't tell the process id of the other end
+func peerPID(conn net.Conn) int {
+	return 0
+}
@@ -0,0 +1,153 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ErrQueueFull - returned by Send (and Receive) with OverflowError when a message didn't fit into its queue
+var ErrQueueFull = errors.New("message queue is full")
+
+var errQueueClosed = errors.New("message queue has been closed")
+
+// OverflowPolicy - what happens to a message that doesn't fit into its queue
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota // wait for room: a slow Receive stalls reading from the connection, a slow peer stalls Send (default)
+	OverflowDrop                        // drop the message silently
+	OverflowError                       // drop the message, Send returns ErrQueueFull, for received messages the next Receive does
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "Block"
+	case OverflowDrop:
+		return "Drop"
+	case OverflowError:
+		return "Error"
+	default:
+		return "<Unknown>"
+	}
+}
+
+// QueueStats - the state of the incoming (received, not yet returned by Receive) and outgoing (sent, not yet written) queues
+type QueueStats struct {
+	Incoming QueueStat
+	Outgoing QueueStat
+}
+
+// QueueStat - the state of one queue
+type QueueStat struct {
+	Depth     int            // messages in the queue right now
+	Capacity  int            // the configured queue size
+	HighWater int            // the highest depth so far
+	Dropped   uint64         // messages dropped (or rejected with ErrQueueFull) because the queue was full
+	Policy    OverflowPolicy // what happens to messages that don't fit
+}
+
+// messageQueue - a bounded queue of messages between the connection's goroutines and Send/Receive
+type messageQueue struct {
+	direction  Direction
+	messages   chan *Message
+	policy     OverflowPolicy
+	metrics    Metrics
+	log        *slog.Logger
+	highWater  atomic.Int64
+	dropped    atomic.Uint64
+	overflowed atomic.Bool // a message has been dropped with OverflowError, the consumer hasn't been told yet
+}
+
+// checkQueueConfig rejects a queue of size 0 with OverflowDrop or OverflowError: without room, every message
+// that doesn't arrive exactly while the other side waits for it would be dropped.
+func checkQueueConfig(direction Direction, size int, policy OverflowPolicy) error {
+	if size == 0 && policy != OverflowBlock {
+		return errors.New(fmt.Sprintf("%s queue of size 0 needs OverflowBlock, not Overflow%s (set a queue size to drop messages)", direction, policy))
+	}
+	return nil
+}
+
+func newMessageQueue(direction Direction, size int, policy OverflowPolicy, metrics Metrics, log *slog.Logger) *messageQueue {
+	return &messageQueue{
+		direction: direction,
+		messages:  make(chan *Message, size),
+		policy:    policy,
+		metrics:   metrics,
+		log:       log.With("queue", direction),
+	}
+}
+
+// put queues msg according to the policy, it fails with ErrQueueFull (OverflowError only) or errQueueClosed once done is closed.
+// Dropped messages' files are closed.
+func (q *messageQueue) put(msg *Message, done <-chan struct{}) error {
+	select {
+	case <-done:
+		closeFiles(msg.Files)
+		return errQueueClosed
+	default:
+	}
+
+	if q.policy == OverflowBlock {
+		select {
+		case q.messages <- msg:
+		case <-done:
+			closeFiles(msg.Files)
+			return errQueueClosed
+		}
+	} else {
+		select {
+		case q.messages <- msg:
+		default:
+			closeFiles(msg.Files)
+			q.dropped.Add(1)
+			q.log.Debug("queue is full, dropped a message", "msg_type", msg.MsgType, "policy", q.policy)
+			if q.policy == OverflowError {
+				q.overflowed.Store(true)
+				return ErrQueueFull
+			}
+			return nil
+		}
+	}
+
+	depth := int64(len(q.messages))
+	q.metrics.QueueDepth(q.direction, int(depth))
+	for {
+		highWater := q.highWater.Load()
+		if depth <= highWater || q.highWater.CompareAndSwap(highWater, depth) {
+			return nil
+		}
+	}
+}
+
+// take waits for the next message, it fails with errQueueClosed once done is closed.
+// After messages have been dropped with OverflowError the first take fails with ErrQueueFull.
+func (q *messageQueue) take(done <-chan struct{}) (*Message, error) {
+	if q.overflowed.Swap(false) {
+		return nil, ErrQueueFull
+	}
+	select {
+	case msg := <-q.messages:
+		q.taken()
+		return msg, nil
+	case <-done:
+		return nil, errQueueClosed
+	}
+}
+
+// taken reports the depth after a message has been taken from the queue
+func (q *messageQueue) taken() {
+	q.metrics.QueueDepth(q.direction, len(q.messages))
+}
+
+func (q *messageQueue) stat() QueueStat {
+	return QueueStat{
+		Depth:     len(q.messages),
+		Capacity:  cap(q.messages),
+		HighWater: int(q.highWater.Load()),
+		Dropped:   q.dropped.Load(),
+		Policy:    q.policy,
+	}
+}
@@ -0,0 +1,109 @@
+package ipc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessageQueueOverflowPolicies(t *testing.T) {
+	done := make(chan struct{})
+
+	drop := newMessageQueue(Inbound, 2, OverflowDrop, noMetrics{}, discardLogger)
+	for i := 0; i < 5; i++ {
+		if err := drop.put(NewMessage(Custom, nil), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stat := drop.stat(); stat.Depth != 2 || stat.HighWater != 2 || stat.Dropped != 3 {
+		t.Errorf("OverflowDrop: %+v", stat)
+	}
+
+	reject := newMessageQueue(Inbound, 1, OverflowError, noMetrics{}, discardLogger)
+	reject.put(NewMessage(Custom, []byte("kept")), done)
+	if err := reject.put(NewMessage(Custom, nil), done); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("OverflowError: put returned %v", err)
+	}
+	if _, err := reject.take(done); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("OverflowError: first take after a drop returned %v", err)
+	}
+	if m, err := reject.take(done); err != nil || string(m.Data) != "kept" {
+		t.Fatalf("OverflowError: take returned %v, %v", m, err)
+	}
+
+	block := newMessageQueue(Inbound, 1, OverflowBlock, noMetrics{}, discardLogger)
+	block.put(NewMessage(Custom, nil), done)
+	blocked := make(chan error)
+	go func() { blocked <- block.put(NewMessage(Custom, nil), done) }()
+	select {
+	case err := <-blocked:
+		t.Fatalf("OverflowBlock: put on a full queue returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(done)
+	if err := <-blocked; !errors.Is(err, errQueueClosed) {
+		t.Errorf("OverflowBlock: put returned %v after done", err)
+	}
+	if block.stat().Dropped != 0 {
+		t.Errorf("OverflowBlock dropped messages")
+	}
+}
+
+func TestNonBlockingPolicyNeedsQueueSize(t *testing.T) {
+	transport := NewMemoryTransport()
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowError} {
+		if s, err := StartServer("test", &ServerConfig{Transport: transport, OutgoingOverflow: policy}); err == nil {
+			s.Close()
+			t.Errorf("server started with an outgoing queue of size 0 and Overflow%s", policy)
+		}
+		if c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, IncomingOverflow: policy}); err == nil {
+			c.Close()
+			t.Errorf("client started with an incoming queue of size 0 and Overflow%s", policy)
+		}
+	}
+
+	s, err := StartServer("test", &ServerConfig{Transport: transport, IncomingQueueSize: 1, IncomingOverflow: OverflowDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestSlowReceiverDoesNotStallSender(t *testing.T) {
+	transport := NewMemoryTransport()
+	s, err := StartServer("test", &ServerConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, IncomingQueueSize: 4, IncomingOverflow: OverflowDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+
+	// nobody receives: the client's queue fills up and drops the rest instead of blocking the server
+	for i := 0; i < 20; i++ {
+		if err := s.Send(Custom, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "all messages queued or dropped", func() bool {
+		stats := c.QueueStats().Incoming
+		return uint64(stats.Depth)+stats.Dropped == 20
+	})
+	stats := c.QueueStats().Incoming
+	if stats.Depth != 4 || stats.HighWater != 4 || stats.Capacity != 4 || stats.Dropped != 16 {
+		t.Errorf("incoming queue: %+v", stats)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := c.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth := c.QueueStats().Incoming.Depth; depth != 0 {
+		t.Errorf("depth %d after receiving all queued messages", depth)
+	}
+}
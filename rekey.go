@@ -0,0 +1,166 @@
+package ipc
+
+import (
+	"errors"
+	"github.com/hoffigolang/golang-ipc/encryption"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// keyRotation holds the encryption.Session of a connection and schedules its session key rotation.
+//
+// the client initiates a rotation after RekeyAfterFrames frames or RekeyAfterDuration (whatever comes first):
+// client -> server: rekeyRequest  (client's new public key, encrypted with the old key)
+// server -> client: rekeyResponse (server's new public key, encrypted with the old key), server sends with the new key afterward
+// client -> server: rekeyCommit   (encrypted with the old key), client sends with the new key afterward
+// as frames on the connection are ordered, each side knows exactly which frame is the last one encrypted with the old key.
+//
+// only the writing goroutine writes to the connection: the reading goroutine queues its replies as control frames,
+// so it never blocks on a peer that is busy writing itself.
+type keyRotation struct {
+	session       *encryption.Session // nil if the connection is not encrypted
+	control       chan controlFrame   // frames of the reading goroutine, written by the writing goroutine
+	afterFrames   uint64
+	afterDuration time.Duration
+	log           *slog.Logger // of the connection
+}
+
+// errRekeyUnencrypted - a peer sent a rekey frame although the connection is not encrypted, the connection gets dropped
+var errRekeyUnencrypted = errors.New("rekey on an unencrypted connection")
+
+// controlFrame writes an internal frame to the connection (called by the writing goroutine only)
+type controlFrame func(conn net.Conn) error
+
+func newKeyRotation() keyRotation {
+	return keyRotation{control: make(chan controlFrame, 4)}
+}
+
+func (kr *keyRotation) reset(session *encryption.Session, afterFrames uint64, afterDuration time.Duration, log *slog.Logger) {
+	kr.session = session
+	kr.afterFrames = afterFrames
+	kr.afterDuration = afterDuration
+	kr.log = log
+	for len(kr.control) > 0 {
+		<-kr.control // frames of the previous connection
+	}
+}
+
+// writeFrame writes a single frame (lengthOfMsgTypePlusMessage + MsgType + Message) to the connection.
+// MsgType + Message are encrypted with the session's current send key if the connection is encrypted.
+func (kr *keyRotation) writeFrame(conn net.Conn, msgType MsgType, data []byte) error {
+	frame, err := kr.sealFrame(msgType, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(frame)
+	return err
+}
+
+// writeMessage writes the Message as a single frame, its Files (duplicated by SendFDs) are passed alongside and closed afterward
+func (kr *keyRotation) writeMessage(conn net.Conn, msg *Message) error {
+	msgType, data := msg.MsgType, msg.Data
+	if len(msg.Headers) > 0 {
+		msgType, data = messageWithHeaders, encodeMessageWithHeaders(msg.MsgType, msg.Headers, msg.Data)
+	}
+	if len(msg.Files) == 0 {
+		return kr.writeFrame(conn, msgType, data)
+	}
+	defer closeFiles(msg.Files)
+
+	frame, err := kr.sealFrame(messageWithFiles, encodeMessageWithFiles(msgType, len(msg.Files), data))
+	if err != nil {
+		return err
+	}
+	return writeFrameWithFiles(conn, frame, msg.Files)
+}
+
+func (kr *keyRotation) sealFrame(msgType MsgType, data []byte) ([]byte, error) {
+	var err error
+	toSend := append(msgType.toBytes(), data...)
+	if kr.session != nil {
+		toSend, err = kr.session.Seal(toSend)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(intToBytes(len(toSend)), toSend...), nil
+}
+
+// rejectUnencryptedRekey fails for the rekey frames (rekeyRequest, rekeyResponse and rekeyCommit) if the connection is not encrypted
+func (kr *keyRotation) rejectUnencryptedRekey(msgType MsgType) error {
+	if kr.session == nil && msgType >= rekeyRequest && msgType <= rekeyCommit {
+		return errRekeyUnencrypted
+	}
+	return nil
+}
+
+// open decrypts a received frame with the session's current receive key.
+func (kr *keyRotation) open(encodedData []byte) ([]byte, error) {
+	return kr.session.Open(encodedData)
+}
+
+// clientMaybeStartRekey sends a rekeyRequest to the server if the current key is used up (writing goroutine only).
+func (kr *keyRotation) clientMaybeStartRekey(conn net.Conn) error {
+	if kr.session == nil || !kr.session.RekeyDue(kr.afterFrames, kr.afterDuration) {
+		return nil
+	}
+
+	pub, err := kr.session.StartRekey()
+	if err != nil {
+		return err
+	}
+	err = kr.writeFrame(conn, rekeyRequest, pub)
+	if err != nil {
+		return err
+	}
+	kr.log.Debug("rekey: sent rekey request to server")
+	return nil
+}
+
+// clientReceivedRekeyResponse switches the receiving direction to the new key and queues the rekeyCommit.
+func (kr *keyRotation) clientReceivedRekeyResponse(peerPublicKey []byte) error {
+	err := kr.session.CompleteRekey(peerPublicKey)
+	if err != nil {
+		return err
+	}
+	err = kr.session.ActivateRecv() // server encrypts everything after its rekeyResponse with the new key
+	if err != nil {
+		return err
+	}
+
+	kr.control <- func(conn net.Conn) error {
+		err := kr.writeFrame(conn, rekeyCommit, nil)
+		if err != nil {
+			return err
+		}
+		kr.log.Debug("rekey: switched to new session key")
+		return kr.session.ActivateSend()
+	}
+	return nil
+}
+
+// serverReceivedRekeyRequest queues the rekeyResponse to the client's rekeyRequest, the sending direction switches to the new key right after it.
+func (kr *keyRotation) serverReceivedRekeyRequest(peerPublicKey []byte) error {
+	pub, err := kr.session.RespondRekey(peerPublicKey)
+	if err != nil {
+		return err
+	}
+
+	kr.control <- func(conn net.Conn) error {
+		err := kr.writeFrame(conn, rekeyResponse, pub)
+		if err != nil {
+			return err
+		}
+		kr.log.Debug("rekey: sent rekey response to client, now sending with new session key")
+		return kr.session.ActivateSend()
+	}
+	return nil
+}
+
+// serverReceivedRekeyCommit switches the receiving direction to the new key.
+func (kr *keyRotation) serverReceivedRekeyCommit() error {
+	kr.log.Debug("rekey: now receiving with new session key")
+	return kr.session.ActivateRecv()
+}
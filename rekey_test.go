@@ -0,0 +1,167 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	logClientRekeyed = "rekey: switched to new session key"
+	logServerRekeyed = "rekey: now receiving with new session key"
+)
+
+// startRekeyPair connects an encrypted server and client, their debug logs go to the returned handlers
+func startRekeyPair(t *testing.T, afterFrames uint64, afterDuration time.Duration) (*Server, *Client, *recordingHandler, *recordingHandler) {
+	t.Helper()
+	transport := NewMemoryTransport()
+	serverLog, clientLog := newRecordingHandler(), newRecordingHandler()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: true,
+		Logger: slog.New(serverLog), LogLevels: NewLogLevels(slog.LevelDebug)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: true,
+		RekeyAfterFrames: afterFrames, RekeyAfterDuration: afterDuration,
+		Logger: slog.New(clientLog), LogLevels: NewLogLevels(slog.LevelDebug)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+	return s, c, serverLog, clientLog
+}
+
+// exchange sends count messages with send and checks receive returns all of them in order
+func exchange(count int, send func(MsgType, []byte) error, receive func() (*Message, error)) error {
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			err := send(Custom, []byte(fmt.Sprintf("message %d", i)))
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < count; i++ {
+		m, err := receive()
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if expected := fmt.Sprintf("message %d", i); string(m.Data) != expected {
+			return fmt.Errorf("received %q, expected %q", m.Data, expected)
+		}
+	}
+	return <-errs
+}
+
+func mustExchange(t *testing.T, count int, send func(MsgType, []byte) error, receive func() (*Message, error)) {
+	t.Helper()
+	if err := exchange(count, send, receive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeyTriggeredInEachDirection(t *testing.T) {
+	for _, direction := range []string{"client to server", "server to client"} {
+		t.Run(direction, func(t *testing.T) {
+			s, c, serverLog, clientLog := startRekeyPair(t, 8, time.Hour)
+			defer s.Close()
+			defer c.Close()
+
+			// only one side sends: the client's writing (resp. reading) goroutine starts the rekeys
+			if direction == "client to server" {
+				mustExchange(t, 100, c.Send, s.Receive)
+			} else {
+				mustExchange(t, 100, s.Send, c.Receive)
+			}
+			waitFor(t, "rekeys", func() bool { return clientLog.count(logClientRekeyed) >= 2 && serverLog.count(logServerRekeyed) >= 2 })
+
+			mustExchange(t, 10, c.Send, s.Receive)
+			mustExchange(t, 10, s.Send, c.Receive)
+		})
+	}
+}
+
+func TestRekeyWhileMessagesInFlight(t *testing.T) {
+	s, c, serverLog, clientLog := startRekeyPair(t, 4, time.Hour)
+	defer s.Close()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := exchange(1000, c.Send, s.Receive); err != nil {
+			t.Error("client to server:", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := exchange(1000, s.Send, c.Receive); err != nil {
+			t.Error("server to client:", err)
+		}
+	}()
+	wg.Wait()
+
+	if clientLog.count(logClientRekeyed) < 10 || serverLog.count(logServerRekeyed) < 10 {
+		t.Errorf("only %d client and %d server rekeys", clientLog.count(logClientRekeyed), serverLog.count(logServerRekeyed))
+	}
+	if clientLog.count("could not decrypt message from server") > 0 || serverLog.count("could not decrypt message from client") > 0 {
+		t.Error("a frame was opened with the wrong key")
+	}
+}
+
+func TestRekeyAfterDuration(t *testing.T) {
+	s, c, serverLog, clientLog := startRekeyPair(t, 1<<30, 50*time.Millisecond)
+	defer s.Close()
+	defer c.Close()
+
+	mustExchange(t, 1, c.Send, s.Receive)
+	if clientLog.count(logClientRekeyed) != 0 {
+		t.Fatal("rekeyed before the duration passed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	mustExchange(t, 1, c.Send, s.Receive) // the rekey starts after the next frame
+	waitFor(t, "rekey", func() bool { return clientLog.count(logClientRekeyed) >= 1 && serverLog.count(logServerRekeyed) >= 1 })
+
+	mustExchange(t, 10, c.Send, s.Receive)
+	mustExchange(t, 10, s.Send, c.Receive)
+}
+
+func TestInternalMessagesOnUnencryptedConnection(t *testing.T) {
+	for _, msgType := range []MsgType{messageWithHeaders, handlerFailure, messageWithFiles, rekeyRequest, rekeyResponse, rekeyCommit} {
+		// frames a misbehaving peer could send after the handshake
+		inject := func(crypto *keyRotation) {
+			crypto.control <- func(conn net.Conn) error {
+				frame, err := crypto.sealFrame(msgType, make([]byte, 32))
+				if err == nil {
+					_, err = conn.Write(frame)
+				}
+				return err
+			}
+		}
+		isRekey := msgType >= rekeyRequest && msgType <= rekeyCommit
+
+		s, c := startMemoryPair(t, NewMemoryTransport(), false)
+		inject(&c.crypto)
+		if _, err := s.Receive(); err == nil || (isRekey && !errors.Is(err, errRekeyUnencrypted)) {
+			t.Errorf("server received MsgType %d with error %v", msgType, err)
+		}
+		c.Close()
+		s.Close()
+
+		s, c = startMemoryPair(t, NewMemoryTransport(), false)
+		inject(&s.crypto)
+		if _, err := c.Receive(); err == nil || (isRekey && !errors.Is(err, errRekeyUnencrypted)) {
+			t.Errorf("client received MsgType %d with error %v", msgType, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
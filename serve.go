@@ -0,0 +1,139 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrServerClosed - returned by Serve once the server has been closed
+var ErrServerClosed = errors.New("server has been closed")
+
+// Handler - handles a message received by Serve, replies go through session.
+// ctx is cancelled when the server is closed, it carries the handling span (see ServerConfig.Tracer).
+type Handler func(ctx context.Context, session *Session, msg *Message)
+
+// Session - the connection of one client, all its messages belong to the same Session until it disconnects
+type Session struct {
+	ID     uint64 // the server's SessionID of the connection, see StatusEvent
+	server *Server
+}
+
+// Send - writes a message to the session's client, it fails if that client has disconnected meanwhile
+// (messages are never delivered to a client that connected later)
+func (session *Session) Send(msgType MsgType, message []byte) error {
+	return session.SendContext(context.Background(), msgType, message)
+}
+
+// SendContext - writes a message like Send, the span of ctx (e.g. the Handler's) is the parent of the sending span
+func (session *Session) SendContext(ctx context.Context, msgType MsgType, message []byte) error {
+	return session.server.send(ctx, session.ID, NewMessage(msgType, message))
+}
+
+// RemoteError - the server failed handling a message of the client (e.g. its Handler panicked), returned by Client.Receive
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "server failed handling a message: " + e.Message
+}
+
+// Serve - receives the messages of all clients and hands each one to handler, running on ServerConfig.ServeWorkers goroutines.
+// With ServerConfig.ServeInOrder the messages of a session are handled one after another in the order received,
+// otherwise concurrently. A panicking handler doesn't crash the server, its client receives a RemoteError instead.
+//
+// Serve blocks until the server is closed and all running handlers returned, then it returns ErrServerClosed.
+// Don't call Receive while serving.
+func (s *Server) Serve(handler Handler) error {
+	if handler == nil {
+		return errors.New("server handler must not be nil")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// in order: the messages of a session always go to the same worker, otherwise all workers share one queue
+	workers := make([]chan *Message, s.conf.ServeWorkers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		if i == 0 || s.conf.ServeInOrder {
+			workers[i] = make(chan *Message)
+		} else {
+			workers[i] = workers[0]
+		}
+		wg.Add(1)
+		go func(messages <-chan *Message) {
+			defer wg.Done()
+			for msg := range messages {
+				s.handle(handler, msg)
+			}
+		}(workers[i])
+	}
+	defer func() {
+		close(workers[0])
+		if s.conf.ServeInOrder {
+			for _, messages := range workers[1:] {
+				close(messages)
+			}
+		}
+		wg.Wait()
+	}()
+
+	for {
+		msg, err := s.receive(ctx)
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			s.log.Warn("Serve: could not receive message", "error", err)
+			continue
+		}
+
+		worker := workers[0]
+		if s.conf.ServeInOrder {
+			worker = workers[msg.sessionID%uint64(len(workers))]
+		}
+		select {
+		case worker <- msg:
+		case <-s.done:
+			closeFiles(msg.Files)
+			return ErrServerClosed
+		}
+	}
+}
+
+// handle runs handler on one message, reporting a panic to the message's client
+func (s *Server) handle(handler Handler, msg *Message) {
+	session := &Session{ID: msg.sessionID, server: s}
+	ctx, span := s.conf.Tracer.Start(msg.Context(), spanHandle, SpanKindServer)
+	span.SetAttribute(attributeIpcName, s.Name)
+	span.SetAttribute(attributeMsgType, int(msg.MsgType))
+	span.SetAttribute(attributeSessionID, session.ID)
+	defer func() {
+		r := recover()
+		if r == nil {
+			span.End(nil)
+			return
+		}
+		span.End(errors.New(fmt.Sprintf("handler panicked: %v", r)))
+		s.log.Error("handler panicked", "session", session.ID, "msg_type", msg.MsgType, "panic", r, "stack", string(debug.Stack()))
+		failure := []byte(fmt.Sprintf("handler panicked on a message of type %d: %v", msg.MsgType, r))
+		err := s.sendToSession(session.ID, NewMessage(handlerFailure, failure))
+		if err != nil {
+			s.log.Debug("could not report the handler's panic to the client", "session", session.ID, "error", err)
+		}
+	}()
+	handler(ctx, session, msg)
+}
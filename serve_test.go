@@ -0,0 +1,129 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startServing(t *testing.T, config ServerConfig, handler Handler) (*Server, *Client, <-chan error) {
+	t.Helper()
+	transport := NewMemoryTransport()
+	config.Transport = transport
+	s, err := StartServer("test", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(handler) }()
+
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, served
+}
+
+func TestServeInOrder(t *testing.T) {
+	echo := func(ctx context.Context, session *Session, msg *Message) {
+		session.Send(msg.MsgType, msg.Data)
+	}
+	s, c, served := startServing(t, ServerConfig{ServeWorkers: 4, ServeInOrder: true}, echo)
+
+	go func() {
+		for i := 0; i < 200; i++ {
+			c.Send(Custom, []byte(strconv.Itoa(i)))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		m, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Data) != strconv.Itoa(i) {
+			t.Fatalf("reply %d is %q", i, m.Data)
+		}
+	}
+
+	c.Close()
+	s.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestServeRecoversHandlerPanic(t *testing.T) {
+	handler := func(ctx context.Context, session *Session, msg *Message) {
+		if string(msg.Data) == "panic" {
+			panic("broken handler")
+		}
+		session.Send(String, []byte("ok"))
+	}
+	s, c, served := startServing(t, ServerConfig{}, handler)
+
+	c.Send(String, []byte("panic"))
+	_, err := c.Receive()
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("client received %v, expected a RemoteError", err)
+	}
+
+	c.Send(String, []byte("still serving?"))
+	if m, err := c.Receive(); err != nil || string(m.Data) != "ok" {
+		t.Fatalf("client received %v, %v after the panic", m, err)
+	}
+
+	c.Close()
+	s.Close()
+	<-served
+}
+
+func TestSessionSendAfterDisconnect(t *testing.T) {
+	sessions := make(chan *Session, 2)
+	handler := func(ctx context.Context, session *Session, msg *Message) {
+		sessions <- session
+	}
+	s, c, served := startServing(t, ServerConfig{}, handler)
+	defer func() {
+		s.Close()
+		<-served
+	}()
+
+	c.Send(String, []byte("hello"))
+	first := <-sessions
+	c.Close()
+	waitFor(t, "server disconnected", func() bool { return s.Status() == SDisconnected })
+
+	c2, err := ClientDialAndHandshake("test", &ClientConfig{Transport: s.conf.Transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.Send(String, []byte("hello"))
+	second := <-sessions
+	if second.ID == first.ID {
+		t.Fatalf("both clients have session %d", first.ID)
+	}
+
+	if err := first.Send(String, []byte("to the first client")); err == nil {
+		t.Error("Send to the disconnected session must fail")
+	}
+	if err := second.Send(String, []byte("to the second client")); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *Message, 1)
+	go func() {
+		m, _ := c2.Receive()
+		received <- m
+	}()
+	select {
+	case m := <-received:
+		if m == nil || string(m.Data) != "to the second client" {
+			t.Errorf("second client received %v", m)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("second client received nothing")
+	}
+}
@@ -1,11 +1,13 @@
 package ipc
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	log "github.com/hoffigolang/golang-ipc/ipclogging"
 	"io"
+	"log/slog"
+	"net"
+	"os"
 	"time"
 )
 
@@ -18,111 +20,243 @@ func StartServer(ipcName string, config *ServerConfig) (*Server, error) {
 		return nil, err
 	}
 
-	s.callback = consumeServerStatusChanges
-	go s.CallbackOnStatusChange(s.callback)
-	err = s.serverRun()
+	listen, err := s.conf.Transport.Listen(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	s.startServing(listen)
+	return s, nil
+}
+
+// StartServerWithListener - starts the ipc server on an already listening socket, e.g. one inherited from systemd (see SystemdListeners).
+// The server doesn't create (or remove) any socket itself then, config.Transport is not used for listening.
+//
+// ipcName - is the name the clients use to connect
+func StartServerWithListener(ipcName string, listen net.Listener, config *ServerConfig) (*Server, error) {
+	if listen == nil {
+		return nil, errors.New("server listener must not be nil")
+	}
+	s, err := createServer(ipcName, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.startServing(listen)
+	return s, nil
+}
+
+func (s *Server) startServing(listen net.Listener) {
+	s.serverRun(listen)
+	s.publishManifest()
 	go s.acceptClientConnectionsLoop()
+}
+
+// Subscribe - returns a channel receiving each following status change of the server (in order),
+// it is closed after SClosed or when cancel is called. Subscribers don't block the server nor each other,
+// events for a slow subscriber are queued.
+func (s *Server) Subscribe() (events <-chan StatusEvent, cancel func()) {
+	return s.state.subscribe()
+}
 
-	return s, err
+// WaitFor - blocks until the server's status satisfies predicate.
+// Returns an error if ctx is done or the status can't satisfy predicate anymore (e.g. the server is closing).
+func (s *Server) WaitFor(ctx context.Context, predicate func(ServerStatus) bool) error {
+	_, err := s.state.waitFor(ctx, predicate)
+	return err
 }
 
-func consumeServerStatusChanges(status ServerStatus) {
-	// nothing
+// WaitListening - blocks until the server accepts clients (SListening, or a client already connected).
+// Returns an error if the server has been closed or ctx is done.
+func (s *Server) WaitListening(ctx context.Context) error {
+	return s.WaitFor(ctx, func(status ServerStatus) bool {
+		return status == SListening || status == SConnected || status == SDisconnected
+	})
 }
+
+// CallbackOnStatusChange - calls onConnected with each following status change (in order) until the server is closed
+//
+// Deprecated: use Subscribe, which also tells the cause of a change.
 func (s *Server) CallbackOnStatusChange(onConnected func(ServerStatus)) {
-	for {
-		status := <-s.statusChannel
-		log.Statusf("server: server status is now '%s'", s.status)
+	events, cancel := s.Subscribe()
+	defer cancel()
+	for event := range events {
 		if onConnected != nil {
-			onConnected(status)
+			onConnected(ServerStatus(event.New))
 		}
 	}
 }
 
+// serverRun starts accepting connections on the given listener
+func (s *Server) serverRun(listen net.Listener) {
+	s.listen = listen
+	s.state.transition(SListening, nil)
+
+	s.log.Debug("listening, waiting for clients to connect", "address", listen.Addr())
+}
+
+// acceptClientConnectionsLoop runs the handshake of each connecting client in its own goroutine,
+// so a client that connects and never speaks can't block other clients (and the listener stays open if a handshake fails).
 func (s *Server) acceptClientConnectionsLoop() {
 	for {
 		conn, err := s.listen.Accept()
 		if err != nil {
 			break
-		} else {
-			log.Debugln("server conn: client wants to connect... initiating handshake...")
 		}
 
-		if s.status == SListening || s.status == SDisconnected {
-			s.conn = conn
-
-			err = s.serverHandshake()
-			if err != nil {
-				s.status = SError
-				s.statusChannel <- SError
-				s.listen.Close()
-				s.conn.Close()
-			} else {
-				s.status = SConnected
-				s.statusChannel <- SConnected
-				s.clientConnectionCount += 1
-				log.Debugln("server (a) client clientConnected <- true")
-				go s.serverReadDataFromConnectionToIncomingChannel()
-				go s.serverWriteDataFromOutgoingChannelToConnection()
-			}
+		select {
+		case s.pendingHandshakes <- struct{}{}:
+			go s.handshakeAndAcceptClient(conn)
+		default:
+			s.log.Warn("too many pending handshakes, rejecting client", "pending_handshakes", cap(s.pendingHandshakes), "peer_pid", peerPID(conn))
+			conn.Close()
 		}
 	}
 }
 
-func (s *Server) serverReadDataFromConnectionToIncomingChannel() {
-	bLen := make([]byte, 4)
+func (s *Server) handshakeAndAcceptClient(conn net.Conn) {
+	defer func() { <-s.pendingHandshakes }()
+
+	log := s.log.With("peer_pid", peerPID(conn))
+	handshakeLog := withSubsystem(log, SubsystemHandshake)
+	handshakeLog.Debug("client wants to connect, initiating handshake")
+	session, err := s.serverHandshake(conn, handshakeLog)
+	s.conf.Metrics.Handshake(handshakeResultOf(err), err)
+	if err != nil {
+		handshakeLog.Warn("handshake with client failed", "error", err)
+		conn.Close()
+		return
+	}
+
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	err = s.state.transitionToNewSession(SConnected) // only while listening or after the previous client disconnected
+	if err != nil {
+		log.Warn("closing connection of another client", "status", s.state.get())
+		conn.Close()
+		return
+	}
 
+	sessionID := s.state.session()
+	log = log.With("session", sessionID)
+	s.conn = conn
+	s.connReader = newConnReader(conn)
+	s.crypto.reset(session, 0, 0, withSubsystem(log, SubsystemCrypto)) // the server never initiates a key rotation
+	s.clientConnectionCount += 1
+	log.Debug("client connected")
+
+	framingLog := withSubsystem(log, SubsystemFraming)
+	connDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	go s.serverReadDataFromConnectionToIncomingChannel(conn, s.connReader, sessionID, framingLog, connDone, writerDone)
+	go s.serverWriteDataFromOutgoingChannelToConnection(conn, sessionID, framingLog, connDone, writerDone)
+}
+
+// serverReadDataFromConnectionToIncomingChannel reads the frames of one client connection.
+// Once the connection is gone, it stops the connection's writing goroutine before the server takes the next client.
+func (s *Server) serverReadDataFromConnectionToIncomingChannel(conn net.Conn, reader *connReader, sessionID uint64, log *slog.Logger, connDone chan struct{}, writerDone chan struct{}) {
+	var connErr error
+	defer func() {
+		log.Debug("connection to client lost", "cause", connErr)
+		conn.Close()
+		reader.closeUnclaimedFiles()
+		close(connDone)
+		<-writerDone
+		s.state.transition(SDisconnected, connErr) // fails if the server is closing
+	}()
+
+	bLen := make([]byte, 4)
 	for {
-		res := s.readDataFromConnection(bLen)
-		if !res {
-			s.conn.Close()
-			break
+		connErr = s.readDataFromConnection(reader, bLen)
+		if connErr != nil {
+			return
 		}
 
 		mLen := bytesToInt(bLen)
 		msg := make([]byte, mLen)
-		res = s.readDataFromConnection(msg)
-		if !res {
-			s.conn.Close()
-			break
+		connErr = s.readDataFromConnection(reader, msg)
+		if connErr != nil {
+			return
 		}
 
 		var err error
 		if s.conf.Encryption {
-			msg, err = decrypt(s.cipher, msg)
+			msg, err = s.crypto.open(msg)
 			if err != nil {
-				s.incoming <- NewIpcErrorMessage(err)
+				s.conf.Metrics.EncryptionError()
+				s.crypto.log.Warn("could not decrypt message from client", "error", err)
+				reader.closeUnclaimedFiles()
+				if !s.deliver(&Message{Err: err, IpcType: OtherError, MsgType: Error, sessionID: sessionID}) {
+					return
+				}
 				continue
 			}
 		}
-		msgTypeInt := bytesToInt(msg[:4])
+		msgType := bytesToMsgType(msg[:4])
 		msgData := msg[4:]
-		if msgTypeInt < 0 {
-			// TODO some func to call for internal messages from the other side
-			log.Debugf("server.serverReadDataFromConnectionToIncomingChannel() msgFinal HandshakeOk: %d", bytesToInt(msg))
+		var m *Message
+		if msgType == messageWithFiles {
+			m, err = receiveMessageWithFiles(reader, msgData)
+			if err != nil {
+				m = NewIpcErrorMessage(err)
+			}
+		} else if msgType == messageWithHeaders {
+			m, err = decodeMessageWithHeaders(msgData)
+			if err != nil {
+				m = NewIpcErrorMessage(err)
+			}
+		} else if msgType < 0 {
+			err = s.handleInternalMessage(msgType, msgData)
+			if errors.Is(err, errRekeyUnencrypted) {
+				log.Warn("dropping connection", "msg_type", msgType, "error", err)
+				s.deliver(&Message{Err: err, IpcType: OtherError, MsgType: Error, sessionID: sessionID})
+				connErr = err
+				return
+			}
+			if err != nil {
+				log.Debug("error handling internal message", "msg_type", msgType, "error", err)
+				m = NewIpcErrorMessage(err)
+			}
 		} else {
-			s.incoming <- NewMessage(MsgType(msgTypeInt), msgData)
+			m = NewMessage(msgType, msgData)
+		}
+		reader.closeUnclaimedFiles()
+		if m != nil && m.Err == nil {
+			s.conf.Metrics.MessageReceived(m.MsgType, len(m.Data))
+		}
+		if m == nil {
+			continue
+		}
+		m.sessionID = sessionID
+		if !s.deliver(m) {
+			return
 		}
 	}
 }
 
-func (s *Server) readDataFromConnection(buff []byte) bool {
-	_, err := io.ReadFull(s.conn, buff)
-	if err != nil {
-		if s.status == SClosing {
-			s.status = SClosed
-			s.statusChannel <- SClosed
-			return false
-		}
+// deliver hands a received message to Receive, false if the server has been closed meanwhile
+func (s *Server) deliver(m *Message) bool {
+	return !errors.Is(s.incoming.put(m, s.done), errQueueClosed)
+}
 
-		if err == io.EOF {
-			s.status = SDisconnected
-			s.statusChannel <- SDisconnected
-			return false
-		}
+// handleInternalMessage reacts to internal messages (MsgType < 0) from the client
+func (s *Server) handleInternalMessage(msgType MsgType, data []byte) error {
+	err := s.crypto.rejectUnencryptedRekey(msgType)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case rekeyRequest:
+		return s.crypto.serverReceivedRekeyRequest(data)
+	case rekeyCommit:
+		return s.crypto.serverReceivedRekeyCommit()
+	default:
+		return errors.New(fmt.Sprintf("server received unknown internal message type %d", msgType))
 	}
+}
 
-	return true
+func (s *Server) readDataFromConnection(reader *connReader, buff []byte) error {
+	_, err := io.ReadFull(reader, buff)
+	return err
 }
 
 //func (s *Server) reConnect() {
@@ -138,24 +272,53 @@ func (s *Server) readDataFromConnection(buff []byte) bool {
 //    }
 //}
 
-// Receive - blocking function, reads each message received
+// Receive - blocking function, reads each message received (that passed the Inbound interceptors, see Use)
 // if MsgType is a negative number it's an internal message
 func (s *Server) Receive() (*Message, error) {
-	msg, ok := <-s.incoming
-	if !ok {
-		return nil, errors.New("server the received channel has been closed")
-	}
+	return s.receive(context.Background())
+}
 
-	if msg.Err != nil {
-		return nil, msg.Err
+// receive returns the next received message, its Context derives from ctx
+func (s *Server) receive(ctx context.Context) (*Message, error) {
+	for {
+		msg, err := s.incoming.take(s.done)
+		if errors.Is(err, errQueueClosed) {
+			return nil, errors.New("server has already closed the connection")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Err != nil {
+			return nil, msg.Err
+		}
+
+		msg, err = s.interceptors.receive(msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			traceReceived(s.conf.Tracer, ctx, s.Name, msg)
+			return msg, nil
+		}
 	}
+}
 
-	return msg, nil
+// Use - adds an Interceptor called with each message sent (Send, SendFDs, Session.Send) and received (Receive, Serve).
+// Interceptors are called in the order they were added.
+func (s *Server) Use(interceptor Interceptor) {
+	s.interceptors.use(interceptor)
 }
 
 // Send - writes a message to the ipc connection
 // msgType - denotes the type of data being sent. 0 is a reserved type for internal messages and errors.
+// If the outgoing queue is full Send waits, drops the message or returns ErrQueueFull, see ServerConfig.OutgoingOverflow
 func (s *Server) Send(msgType MsgType, message []byte) error {
+	return s.SendContext(context.Background(), msgType, message)
+}
+
+// SendContext - writes a message like Send, the span of ctx is the parent of the sending span (see ServerConfig.Tracer)
+func (s *Server) SendContext(ctx context.Context, msgType MsgType, message []byte) error {
 	if msgType <= 0 {
 		return errors.New(fmt.Sprintf("server message type %d is reserved (0 or below)", msgType))
 	}
@@ -166,78 +329,162 @@ func (s *Server) Send(msgType MsgType, message []byte) error {
 		return errors.New("server message exceeds maximum message length")
 	}
 
-	if s.status == SConnected {
-		s.outgoing <- NewMessage(msgType, message)
-	} else {
-		return errors.New(s.status.String())
+	return s.send(ctx, 0, NewMessage(msgType, message))
+}
+
+// send passes msg through the Outbound interceptors, then enqueues it for the client of the given session (0: whichever client is connected)
+func (s *Server) send(ctx context.Context, sessionID uint64, msg *Message) error {
+	span := startSendSpan(s.conf.Tracer, ctx, s.Name, msg)
+	err := s.interceptors.run(Outbound, msg, func(msg *Message) error {
+		if msg.MsgType <= 0 {
+			closeFiles(msg.Files)
+			return errors.New(fmt.Sprintf("server message type %d is reserved (0 or below)", msg.MsgType))
+		}
+		if len(msg.Data) > s.conf.MaxMsgSize {
+			closeFiles(msg.Files)
+			return errors.New("server message exceeds maximum message length")
+		}
+		if err := validateHeaders(msg.Headers); err != nil {
+			closeFiles(msg.Files)
+			return err
+		}
+		return s.sendToSession(sessionID, msg)
+	})
+	span.End(err)
+	return err
+}
+
+// sendToSession enqueues a message for the client of the given session (0: whichever client is connected)
+func (s *Server) sendToSession(sessionID uint64, msg *Message) error {
+	status := s.state.get()
+	if status != SConnected {
+		closeFiles(msg.Files)
+		return errors.New(status.String())
+	}
+	if sessionID != 0 && sessionID != s.state.session() {
+		closeFiles(msg.Files)
+		return errors.New(fmt.Sprintf("session %d has ended, the client has disconnected", sessionID))
 	}
 
-	return nil
+	msg.sessionID = sessionID
+	return s.enqueue(msg)
 }
 
-func (s *Server) serverWriteDataFromOutgoingChannelToConnection() {
-	var err error
-	for {
-		msg, ok := <-s.outgoing
-		if !ok {
-			break
-		}
+// enqueue hands a message to the writing goroutine, waiting for the next client while the current one reconnects
+func (s *Server) enqueue(msg *Message) error {
+	msg.queuedAt = time.Now()
+	err := s.outgoing.put(msg, s.done)
+	if errors.Is(err, errQueueClosed) {
+		return errors.New(s.state.get().String())
+	}
+	return err
+}
 
-		toSend := msg.MsgType.toBytes()
-		writer := bufio.NewWriter(s.conn)
+// SendFDs - writes a message to the ipc connection and passes the files' descriptors alongside (SCM_RIGHTS).
+// Only supported on unix socket connections, returns ErrFDPassingNotSupported otherwise.
+// The files are duplicated, the caller may close them right after SendFDs returned.
+func (s *Server) SendFDs(msgType MsgType, message []byte, files ...*os.File) error {
+	if msgType <= 0 {
+		return errors.New(fmt.Sprintf("server message type %d is reserved (0 or below)", msgType))
+	}
 
-		if s.conf.Encryption {
-			toSend = append(toSend, msg.Data...)
-			toSend, err = encrypt(s.cipher, toSend)
-			if err != nil {
-				log.Debugln("server error encrypting data", err)
+	if len(message) > s.conf.MaxMsgSize {
+		return errors.New("server message exceeds maximum message length")
+	}
+
+	status := s.state.get()
+	if status != SConnected {
+		return errors.New(status.String())
+	}
 
+	s.connMutex.Lock()
+	conn := s.conn
+	s.connMutex.Unlock()
+	msg, err := newFilesMessage(conn, msgType, message, files)
+	if err != nil {
+		return err
+	}
+	return s.send(context.Background(), 0, msg)
+}
+
+// serverWriteDataFromOutgoingChannelToConnection writes to one client connection until the reading goroutine noticed it's gone,
+// messages sent to an earlier session (see Session.Send) are dropped
+func (s *Server) serverWriteDataFromOutgoingChannelToConnection(conn net.Conn, sessionID uint64, log *slog.Logger, connDone <-chan struct{}, writerDone chan<- struct{}) {
+	defer close(writerDone)
+	for {
+		select {
+		case <-connDone:
+			return
+		case <-s.done:
+			return
+		case writeControlFrame := <-s.crypto.control:
+			err := writeControlFrame(conn)
+			if err != nil {
+				log.Debug("error writing internal message", "error", err)
+			}
+		case msg := <-s.outgoing.messages:
+			s.outgoing.taken()
+			if msg.sessionID != 0 && msg.sessionID != sessionID {
+				log.Debug("dropped a message to an earlier session, its client has disconnected", "msg_type", msg.MsgType, "to_session", msg.sessionID)
+				closeFiles(msg.Files)
 				continue
 			}
-		} else {
-			toSend = append(toSend, msg.Data...)
-		}
+			err := s.crypto.writeMessage(conn, msg)
+			if err != nil {
+				log.Debug("error writing data", "msg_type", msg.MsgType, "error", err)
 
-		writer.Write(intToBytes(len(toSend)))
-		writer.Write(toSend)
-		err = writer.Flush()
-		if err != nil {
-			log.Debugln("server error flushing data", err)
+				continue
+			}
+			s.messageWritten(msg)
 
-			continue
+			time.Sleep(10_000 * time.Nanosecond)
 		}
+	}
+}
 
-		time.Sleep(10_000 * time.Nanosecond)
+// messageWritten reports a message written to the connection to the Metrics
+func (s *Server) messageWritten(msg *Message) {
+	if msg.MsgType > 0 {
+		s.conf.Metrics.MessageSent(msg.MsgType, len(msg.Data))
+		s.conf.Metrics.SendLatency(time.Since(msg.queuedAt))
 	}
 }
 
 // Status - returns the current connection status
 func (s *Server) Status() ServerStatus {
-	return s.status
+	return s.state.get()
+}
+
+// QueueStats - returns the current depth, high-water mark and drops of the incoming and outgoing queues
+func (s *Server) QueueStats() QueueStats {
+	return QueueStats{Incoming: s.incoming.stat(), Outgoing: s.outgoing.stat()}
+}
+
+// LogLevels - the levels of the server's logs, changing them takes effect immediately
+func (s *Server) LogLevels() *LogLevels {
+	return s.conf.LogLevels
 }
 
-// Close - closes the connection
+// Close - closes the connection and stops listening, pending Receive and Send calls return an error
 func (s *Server) Close() {
-	s.status = SClosing
-	s.statusChannel <- SClosing
+	err := s.state.transition(SClosing, nil)
+	if err != nil {
+		return // already closing
+	}
+	close(s.done)
 
 	if s.listen != nil {
+		s.removeManifest()
 		s.listen.Close()
 	}
 
+	s.connMutex.Lock()
 	if s.conn != nil {
 		s.conn.Close()
 	}
+	s.connMutex.Unlock()
 
-	if s.incoming != nil {
-		s.incoming <- NewIpcConnectionErrorMessage(errors.New("server has already closed the connection"))
-
-		close(s.incoming)
-	}
-
-	if s.outgoing != nil {
-		close(s.outgoing)
-	}
+	s.state.transition(SClosed, nil)
 }
 
 func createServer(ipcName string, config *ServerConfig) (*Server, error) {
@@ -248,11 +495,9 @@ func createServer(ipcName string, config *ServerConfig) (*Server, error) {
 
 	s := &Server{
 		Name:                  ipcName,
-		status:                SNotConnected,
+		done:                  make(chan struct{}),
 		clientConnectionCount: 0,
-		statusChannel:         make(chan ServerStatus),
-		incoming:              make(chan *Message),
-		outgoing:              make(chan *Message),
+		crypto:                newKeyRotation(),
 	}
 
 	if config == nil {
@@ -261,6 +506,18 @@ func createServer(ipcName string, config *ServerConfig) (*Server, error) {
 		s.conf = *config
 	}
 
+	if s.conf.LogLevels == nil {
+		s.conf.LogLevels = LogLevelsFromEnv()
+	}
+	if s.conf.Logger == nil {
+		s.conf.Logger = slog.Default()
+		s.log = newDefaultLogger(s.conf.LogLevels)
+	} else {
+		s.log = newLogger(s.conf.Logger, s.conf.LogLevels)
+	}
+	s.log = s.log.With("ipc", ipcName, "role", "server")
+	s.state = newStatusMachine("server", SNotConnected, serverTransitions, s.log)
+
 	if s.conf.Timeout < 0 {
 		s.conf.Timeout = DefaultServerConfig.Timeout
 	}
@@ -270,5 +527,42 @@ func createServer(ipcName string, config *ServerConfig) (*Server, error) {
 	if s.conf.SocketBasePath == "" {
 		s.conf.SocketBasePath = DefaultServerConfig.SocketBasePath
 	}
+	if s.conf.Transport == nil {
+		s.conf.Transport = newDefaultTransport(s.conf)
+	}
+	if len(s.conf.CipherSuites) == 0 {
+		s.conf.CipherSuites = DefaultServerConfig.CipherSuites
+	}
+	if s.conf.HandshakeTimeout <= 0 {
+		s.conf.HandshakeTimeout = DefaultServerConfig.HandshakeTimeout
+	}
+	if s.conf.MaxPendingHandshakes <= 0 {
+		s.conf.MaxPendingHandshakes = DefaultServerConfig.MaxPendingHandshakes
+	}
+	s.pendingHandshakes = make(chan struct{}, s.conf.MaxPendingHandshakes)
+	if s.conf.ServeWorkers <= 0 {
+		s.conf.ServeWorkers = DefaultServerConfig.ServeWorkers
+	}
+	if s.conf.IncomingQueueSize < 0 {
+		s.conf.IncomingQueueSize = DefaultServerConfig.IncomingQueueSize
+	}
+	if s.conf.OutgoingQueueSize < 0 {
+		s.conf.OutgoingQueueSize = DefaultServerConfig.OutgoingQueueSize
+	}
+	if s.conf.Metrics == nil {
+		s.conf.Metrics = noMetrics{}
+	}
+	if s.conf.Tracer == nil {
+		s.conf.Tracer = noTracer{}
+	}
+	err = checkQueueConfig(Inbound, s.conf.IncomingQueueSize, s.conf.IncomingOverflow)
+	if err == nil {
+		err = checkQueueConfig(Outbound, s.conf.OutgoingQueueSize, s.conf.OutgoingOverflow)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.incoming = newMessageQueue(Inbound, s.conf.IncomingQueueSize, s.conf.IncomingOverflow, s.conf.Metrics, s.log)
+	s.outgoing = newMessageQueue(Outbound, s.conf.OutgoingQueueSize, s.conf.OutgoingOverflow, s.conf.Metrics, s.log)
 	return s, nil
 }
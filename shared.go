@@ -1,11 +1,26 @@
 package ipc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
 
 // checks the name passed into the start function to ensure it's ok/will work.
+// The name may contain sub-directories (e.g. "myapp/control"), but must stay within the socket base path.
 func ipcNameValidate(ipcName string) error {
 	if len(ipcName) == 0 {
 		return errors.New("ipcName cannot be an empty string")
 	}
+	name := filepath.ToSlash(ipcName)
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(ipcName) {
+		return errors.New(fmt.Sprintf("ipcName '%s' must be relative to the socket base path", ipcName))
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return errors.New(fmt.Sprintf("ipcName '%s' contains an empty, '.' or '..' path element", ipcName))
+		}
+	}
 	return nil
 }
@@ -0,0 +1,228 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const socketProbeTimeout = time.Second
+
+// socketFileListener - removes the socket file and releases the lock when closed
+type socketFileListener struct {
+	*net.UnixListener
+	socketPath string
+	lock       *os.File
+	closeOnce  sync.Once
+}
+
+// Addr - the socket file's path (the socket was created under a temporary name)
+func (l *socketFileListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.socketPath, Net: "unix"}
+}
+
+func (l *socketFileListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.UnixListener.Close()
+		// still holding the lock, so the socket file is ours
+		if removeErr := os.Remove(l.socketPath); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+		l.lock.Close() // releases the lock
+	})
+	return err
+}
+
+// listenSocketFile creates the unix socket at socketPath, unless another server owns it.
+//
+// The socket is created in a private directory, gets its mode and owner there and is then renamed to socketPath,
+// so no client can connect before the permissions are set.
+func listenSocketFile(socketPath string, mode os.FileMode, owner string, group string) (net.Listener, error) {
+	lock, err := lockSocketFile(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = removeStaleSocket(socketPath)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	listen, err := listenPrivateAndRename(socketPath, mode, owner, group)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return &socketFileListener{UnixListener: listen, socketPath: socketPath, lock: lock}, nil
+}
+
+// lockSocketFile takes an exclusive lock on <socketPath>.lock, which is held as long as the server listens
+func lockSocketFile(socketPath string) (*os.File, error) {
+	lockPath := socketPath + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(int(lock.Fd()))
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errors.New(fmt.Sprintf("another server is already running on %s (%s is locked)", socketPath, lockPath))
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// removeStaleSocket removes the socket file at socketPath if no server answers on it anymore
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(fmt.Sprintf("%s exists and is not a unix socket, not removing it", socketPath))
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return errors.New(fmt.Sprintf("another server is already listening on %s", socketPath))
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, syscall.ENOENT) {
+		return errors.New(fmt.Sprintf("cannot tell if %s is still in use: %s", socketPath, err))
+	}
+
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func listenPrivateAndRename(socketPath string, mode os.FileMode, owner string, group string) (*net.UnixListener, error) {
+	privateDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".ipc-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+
+	privatePath := filepath.Join(privateDir, "s")
+	listen, err := net.ListenUnix("unix", &net.UnixAddr{Name: privatePath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listen.SetUnlinkOnClose(false) // the socket file gets renamed, socketFileListener removes it
+
+	err = setSocketPermissions(privatePath, mode, owner, group)
+	if err == nil {
+		err = os.Rename(privatePath, socketPath)
+	}
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return listen, nil
+}
+
+func setSocketPermissions(path string, mode os.FileMode, owner string, group string) error {
+	if owner != "" || group != "" {
+		uid, gid, err := lookupOwnerAndGroup(owner, group)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mode != 0 {
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// lookupOwnerAndGroup resolves user/group names or numeric ids, -1 if not given
+func lookupOwnerAndGroup(owner string, group string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if owner != "" {
+		id, err := strconv.Atoi(owner)
+		if err != nil {
+			u, lookupErr := user.Lookup(owner)
+			if lookupErr != nil {
+				return -1, -1, lookupErr
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(group)
+			if lookupErr != nil {
+				return -1, -1, lookupErr
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+// prepareSocketDir creates the directory of the socket file including the sub-directories of the ipc name.
+// The default base path has to be private: owned by the current user and not accessible by anyone else.
+func prepareSocketDir(basePath string, socketDir string) error {
+	if filepath.Clean(basePath) == filepath.Clean(defaultSocketBasePath) {
+		err := ensurePrivateDir(basePath)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(socketDir, 0755)
+}
+
+func ensurePrivateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(fmt.Sprintf("socket base path %s is not a directory", dir))
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return errors.New(fmt.Sprintf("socket base path %s is not owned by the current user", dir))
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return errors.New(fmt.Sprintf("socket base path %s is accessible by other users (mode %s), expected 0700", dir, info.Mode().Perm()))
+	}
+	return nil
+}
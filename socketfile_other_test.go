@@ -0,0 +1,105 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// shortTempDir returns a temporary directory, t.TempDir() may exceed the maximum unix socket path length
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSecondServerIsRefused(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "test.sock")
+	listen, err := listenSocketFile(socketPath, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	if second, err := listenSocketFile(socketPath, 0, "", ""); err == nil {
+		second.Close()
+		t.Fatal("a second server listens on the same socket")
+	}
+	// the first server still listens
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestStaleSocketIsTakenOver(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "test.sock")
+	crashed, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed.SetUnlinkOnClose(false) // leaves the socket file behind, like a server that crashed
+	crashed.Close()
+
+	listen, err := listenSocketFile(socketPath, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestOtherFileIsNotRemoved(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "test.sock")
+	if err := os.WriteFile(socketPath, []byte("not a socket"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listen, err := listenSocketFile(socketPath, 0, "", ""); err == nil {
+		listen.Close()
+		t.Fatal("replaced a regular file with the socket")
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocketIsRemovedOnClose(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "test.sock")
+	listen, err := listenSocketFile(socketPath, 0600, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("socket file has mode %s", info.Mode())
+	}
+
+	if err := listen.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Close: %v", err)
+	}
+	// and the next server takes over right away
+	listen, err = listenSocketFile(socketPath, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen.Close()
+}
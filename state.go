@@ -0,0 +1,262 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusEvent - a status change of a Server or Client, see Subscribe
+type StatusEvent struct {
+	Old       Status
+	New       Status
+	Time      time.Time
+	Err       error  // what caused the change, e.g. the error that ended the connection (nil if requested, e.g. by Close)
+	SessionID uint64 // the connection the change belongs to, counting from 1 (0 before the first connection)
+}
+
+// statusMachine - the connection status of a Server or Client.
+//
+// The status is read atomically and only changes along the transitions of its table (e.g. no CConnected after CClosed),
+// so goroutines racing for a change (reader, Close, reconnect, ...) can't undo each other's: exactly one of them wins.
+// Changes are queued for each subscriber, changing the status never blocks.
+type statusMachine[S ~int] struct {
+	name        string // for error messages
+	log         *slog.Logger
+	current     atomic.Int64
+	mutex       sync.Mutex // serializes transitions, so subscribers get the changes in order
+	transitions map[S][]S  // statuses without transitions are final
+	sessionID   uint64
+	subscribers map[*statusSubscriber]struct{}
+}
+
+func newStatusMachine[S ~int](name string, initial S, transitions map[S][]S, log *slog.Logger) *statusMachine[S] {
+	m := &statusMachine[S]{
+		name:        name,
+		log:         log,
+		transitions: transitions,
+		subscribers: make(map[*statusSubscriber]struct{}),
+	}
+	m.current.Store(int64(initial))
+	return m
+}
+
+var serverTransitions = map[ServerStatus][]ServerStatus{
+	SNotConnected: {SListening, SClosing},
+	SListening:    {SConnected, SClosing},
+	SConnected:    {SDisconnected, SClosing},
+	SDisconnected: {SConnected, SClosing},
+	SClosing:      {SClosed},
+}
+
+var clientTransitions = map[ClientStatus][]ClientStatus{
+	CNotConnected: {CConnecting, CClosing},
+	CConnecting:   {CConnected, CError, CTimeout, CClosing},
+	CConnected:    {CReConnecting, CClosing},
+	CReConnecting: {CConnected, CError, CTimeout, CClosing},
+	CError:        {CClosing},
+	CTimeout:      {CClosing},
+	CClosing:      {CClosed},
+}
+
+func (m *statusMachine[S]) get() S {
+	return S(m.current.Load())
+}
+
+// transition changes the status to the given one if the table allows it from the current status
+func (m *statusMachine[S]) transition(to S, cause error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.transitionLocked(to, cause, false)
+}
+
+// transitionToNewSession changes the status like transition, the change (and all following) belong to a new connection
+func (m *statusMachine[S]) transitionToNewSession(to S) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.transitionLocked(to, nil, true)
+}
+
+func (m *statusMachine[S]) transitionLocked(to S, cause error, newSession bool) error {
+	from := m.get()
+	if !m.allowed(from, to) {
+		return errors.New(fmt.Sprintf("invalid status transition from '%s' to '%s'", StatusString(Status(from)), StatusString(Status(to))))
+	}
+
+	m.current.Store(int64(to))
+	if newSession {
+		m.sessionID++
+	}
+	attrs := []any{"status", StatusString(Status(to)), "old_status", StatusString(Status(from)), "session", m.sessionID}
+	if cause != nil {
+		attrs = append(attrs, "cause", cause)
+	}
+	m.log.Debug("status changed", attrs...)
+
+	event := StatusEvent{Old: Status(from), New: Status(to), Time: time.Now(), Err: cause, SessionID: m.sessionID}
+	final := m.final(to)
+	for sub := range m.subscribers {
+		sub.push(event, final)
+	}
+	if final {
+		clear(m.subscribers)
+	}
+	return nil
+}
+
+func (m *statusMachine[S]) allowed(from S, to S) bool {
+	for _, allowed := range m.transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *statusMachine[S]) final(status S) bool {
+	return len(m.transitions[status]) == 0
+}
+
+// waitFor blocks until the status satisfies done and returns the change that satisfied it (or the current status if it already does).
+// It fails if ctx is done or no status satisfying done can be reached anymore (e.g. CError, which only leads to closing),
+// with the cause of the change that led there.
+func (m *statusMachine[S]) waitFor(ctx context.Context, done func(S) bool) (StatusEvent, error) {
+	events, cancel := m.subscribe() // before looking at the current status, so no change gets lost
+	defer cancel()
+
+	current := m.get()
+	if done(current) {
+		return StatusEvent{Old: Status(current), New: Status(current), Time: time.Now(), SessionID: m.session()}, nil
+	}
+	if !m.reachable(current, done) {
+		return StatusEvent{}, errors.New(fmt.Sprintf("%s is '%s'", m.name, StatusString(Status(current))))
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return StatusEvent{}, errors.New(fmt.Sprintf("%s is '%s'", m.name, StatusString(Status(m.get()))))
+			}
+			if done(S(event.New)) {
+				return event, nil
+			}
+			if !m.reachable(S(event.New), done) {
+				if event.Err != nil {
+					return event, fmt.Errorf("%s is '%s': %w", m.name, StatusString(event.New), event.Err)
+				}
+				return event, errors.New(fmt.Sprintf("%s is '%s'", m.name, StatusString(event.New)))
+			}
+		case <-ctx.Done():
+			return StatusEvent{}, ctx.Err()
+		}
+	}
+}
+
+// reachable tells if a status satisfying done can still be reached from status along the transitions
+func (m *statusMachine[S]) reachable(status S, done func(S) bool) bool {
+	seen := map[S]bool{status: true}
+	next := []S{status}
+	for len(next) > 0 {
+		status, next = next[len(next)-1], next[:len(next)-1]
+		for _, to := range m.transitions[status] {
+			if done(to) {
+				return true
+			}
+			if !seen[to] {
+				seen[to] = true
+				next = append(next, to)
+			}
+		}
+	}
+	return false
+}
+
+func (m *statusMachine[S]) session() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.sessionID
+}
+
+// subscribe returns a channel receiving all following status changes, it is closed after the final status or by cancel
+func (m *statusMachine[S]) subscribe() (<-chan StatusEvent, func()) {
+	sub := &statusSubscriber{
+		events: make(chan StatusEvent),
+		wakeup: make(chan struct{}, 1),
+		cancel: make(chan struct{}),
+	}
+
+	m.mutex.Lock()
+	if m.final(m.get()) {
+		sub.final = true // nothing will change anymore
+	} else {
+		m.subscribers[sub] = struct{}{}
+	}
+	m.mutex.Unlock()
+	go sub.run()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			delete(m.subscribers, sub)
+			m.mutex.Unlock()
+			close(sub.cancel)
+		})
+	}
+	return sub.events, cancel
+}
+
+// statusSubscriber - queues the events of one subscriber, so a slow one neither blocks status changes nor other subscribers
+type statusSubscriber struct {
+	events chan StatusEvent
+	mutex  sync.Mutex
+	queue  []StatusEvent
+	final  bool // the final event has been queued
+	wakeup chan struct{}
+	cancel chan struct{}
+}
+
+func (sub *statusSubscriber) push(event StatusEvent, final bool) {
+	sub.mutex.Lock()
+	sub.queue = append(sub.queue, event)
+	sub.final = sub.final || final
+	sub.mutex.Unlock()
+
+	select {
+	case sub.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *statusSubscriber) run() {
+	defer close(sub.events)
+	for {
+		sub.mutex.Lock()
+		if len(sub.queue) == 0 {
+			final := sub.final
+			sub.mutex.Unlock()
+			if final {
+				return
+			}
+			select {
+			case <-sub.wakeup:
+				continue
+			case <-sub.cancel:
+				return
+			}
+		}
+		event := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mutex.Unlock()
+
+		select {
+		case sub.events <- event:
+		case <-sub.cancel:
+			return
+		}
+	}
+}
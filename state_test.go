@@ -0,0 +1,500 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with: go test -race
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func startMemoryPair(t *testing.T, transport *MemoryTransport, encryption bool) (*Server, *Client) {
+	t.Helper()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: encryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ClientDialAndHandshake("test", &ClientConfig{
+		Transport:        transport,
+		Encryption:       encryption,
+		RetryTimer:       10 * time.Millisecond,
+		RekeyAfterFrames: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+	return s, c
+}
+
+func TestStatusMachineRejectsInvalidTransitions(t *testing.T) {
+	m := newStatusMachine("client", CNotConnected, clientTransitions, discardLogger)
+
+	events, _ := m.subscribe()
+
+	if err := m.transition(CConnected, nil); err == nil {
+		t.Error("CNotConnected -> CConnected must be rejected")
+	}
+	for _, status := range []ClientStatus{CConnecting, CConnected, CClosing, CClosed} {
+		if err := m.transition(status, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, status := range []ClientStatus{CConnected, CReConnecting, CClosing} {
+		if err := m.transition(status, nil); err == nil {
+			t.Errorf("%s after CClosed must be rejected", status)
+		}
+	}
+	if m.get() != CClosed {
+		t.Errorf("status is %s, expected %s", m.get(), CClosed)
+	}
+
+	var delivered []ClientStatus
+	for event := range events { // closed after the final status
+		delivered = append(delivered, ClientStatus(event.New))
+	}
+	expected := []ClientStatus{CConnecting, CConnected, CClosing, CClosed}
+	if len(delivered) != len(expected) {
+		t.Fatalf("delivered %v, expected %v", delivered, expected)
+	}
+	for i := range expected {
+		if delivered[i] != expected[i] {
+			t.Fatalf("delivered %v, expected %v", delivered, expected)
+		}
+	}
+}
+
+func TestStatusMachineConcurrentTransitionsHaveOneWinner(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		m := newStatusMachine("server", SConnected, serverTransitions, discardLogger)
+		var wg sync.WaitGroup
+		results := make(chan error, 8)
+		for j := 0; j < cap(results); j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- m.transition(SClosing, nil)
+			}()
+		}
+		wg.Wait()
+		close(results)
+
+		succeeded := 0
+		for err := range results {
+			if err == nil {
+				succeeded++
+			}
+		}
+		if succeeded != 1 || m.get() != SClosing {
+			t.Fatalf("%d goroutines changed the status to %s, expected exactly one", succeeded, m.get())
+		}
+	}
+}
+
+func TestSubscribersGetAllEventsWithoutBlocking(t *testing.T) {
+	m := newStatusMachine("server", SNotConnected, serverTransitions, discardLogger)
+	slow, _ := m.subscribe() // never read until all transitions are done
+	fast, _ := m.subscribe()
+	cancelled, cancel := m.subscribe()
+	cancel()
+
+	connectionLost := errors.New("connection lost")
+	transitions := func() {
+		m.transition(SListening, nil)
+		for i := 0; i < 100; i++ {
+			m.transitionToNewSession(SConnected)
+			m.transition(SDisconnected, connectionLost)
+		}
+		m.transition(SClosing, nil)
+		m.transition(SClosed, nil)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		transitions()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("a subscriber that doesn't read blocked the status changes")
+	}
+
+	for name, events := range map[string]<-chan StatusEvent{"slow": slow, "fast": fast} {
+		count := 0
+		previous := Status(SNotConnected)
+		for event := range events {
+			count++
+			if event.Old != previous {
+				t.Fatalf("%s subscriber: event %d from %s, expected from %s", name, count, event.Old, previous)
+			}
+			previous = event.New
+			if event.New == ServerConnected && event.SessionID != uint64(count/2) {
+				t.Errorf("%s subscriber: session %d at event %d", name, event.SessionID, count)
+			}
+			if event.New == ServerDisconnected && !errors.Is(event.Err, connectionLost) {
+				t.Errorf("%s subscriber: disconnected without cause", name)
+			}
+		}
+		if count != 203 || previous != ServerClosed {
+			t.Errorf("%s subscriber got %d events ending with %s", name, count, previous)
+		}
+	}
+	if _, open := <-cancelled; open {
+		t.Error("cancelled subscription got an event")
+	}
+
+	late, _ := m.subscribe()
+	if _, open := <-late; open {
+		t.Error("subscription after the final status must be closed")
+	}
+}
+
+func TestConcurrentSendAndClose(t *testing.T) {
+	for _, encryption := range []bool{false, true} {
+		s, c := startMemoryPair(t, NewMemoryTransport(), encryption)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(4)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					if c.Send(Custom, []byte("from client")) != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					if s.Send(Custom, []byte("from server")) != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := c.Receive(); err != nil && c.Status() == CClosed {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := s.Receive(); err != nil && s.Status() == SClosed {
+						return
+					}
+				}
+			}()
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		var closing sync.WaitGroup
+		closing.Add(3)
+		go func() { defer closing.Done(); c.Close() }()
+		go func() { defer closing.Done(); c.Close() }()
+		go func() { defer closing.Done(); s.Close() }()
+		closing.Wait()
+		wg.Wait()
+
+		if c.Status() != CClosed || s.Status() != SClosed {
+			t.Fatalf("client %s, server %s after Close", c.Status(), s.Status())
+		}
+		if c.Send(Custom, []byte("late")) == nil || s.Send(Custom, []byte("late")) == nil {
+			t.Error("Send after Close must fail")
+		}
+	}
+}
+
+func TestClientReconnectsWhileSending(t *testing.T) {
+	transport := NewMemoryTransport()
+	s, c := startMemoryPair(t, transport, true)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Send(Custom, []byte("while reconnecting")) // fails while not connected
+			}
+		}
+	}()
+	receiving := make(chan struct{})
+	go func() {
+		defer close(receiving)
+		for {
+			if _, err := s.Receive(); err != nil && s.Status() == SClosed {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	<-receiving
+	waitFor(t, "client reconnecting", func() bool { return c.Status() == CReConnecting })
+
+	s2, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client reconnected", func() bool { return c.Status() == CConnected })
+
+	received := make(chan *Message, 1)
+	go func() {
+		for {
+			m, err := s2.Receive()
+			if err != nil {
+				return
+			}
+			if string(m.Data) == "after reconnect" {
+				received <- m
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Send(Custom, []byte("after reconnect"))
+			}
+		}
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't receive messages after the client reconnected")
+	}
+
+	c.Close()
+	close(stop)
+	wg.Wait()
+	s2.Close()
+	if c.Status() != CClosed {
+		t.Errorf("client %s after Close", c.Status())
+	}
+}
+
+func TestCloseWhileConnecting(t *testing.T) {
+	c, err := DialAndHandshakeAsync("nobody-listening", &ClientConfig{Transport: NewMemoryTransport(), RetryTimer: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client connecting", func() bool { return c.Status() == CConnecting })
+
+	c.Close()
+	time.Sleep(20 * time.Millisecond)
+	if c.Status() != CClosed {
+		t.Errorf("client %s after Close, expected %s", c.Status(), CClosed)
+	}
+}
+
+func TestStatusCallbackMayClose(t *testing.T) {
+	clients := make(chan *Client, 1)
+	closed := make(chan struct{})
+	onStatusChange := func(status ClientStatus) {
+		switch status {
+		case CConnecting:
+			(<-clients).Close() // must not deadlock on its own status change
+		case CClosed:
+			close(closed)
+		}
+	}
+
+	c, err := DialAndHandshakeAsync("nobody-listening", &ClientConfig{Transport: NewMemoryTransport(), RetryTimer: time.Millisecond}, onStatusChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients <- c
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("callback didn't see %s, client is %s", CClosed, c.Status())
+	}
+}
+
+func TestWaitConnected(t *testing.T) {
+	transport := NewMemoryTransport()
+	c, err := DialAndHandshakeAsync("test", &ClientConfig{Transport: transport, RetryTimer: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.WaitConnected(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitConnected without a server returned %v", err)
+	}
+
+	s, err := StartServer("test", &ServerConfig{Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitListening(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitConnected(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitFor(context.Background(), func(status ServerStatus) bool { return status == SConnected }); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	s.Close()
+	if err := c.WaitConnected(context.Background()); err == nil {
+		t.Error("WaitConnected on a closed client must fail")
+	}
+	if err := s.WaitListening(context.Background()); err == nil {
+		t.Error("WaitListening on a closed server must fail")
+	}
+}
+
+func TestWaitConnectedFailsOnTimeout(t *testing.T) {
+	c, err := DialAndHandshakeAsync("nobody-listening", &ClientConfig{Transport: NewMemoryTransport(), Timeout: 20 * time.Millisecond, RetryTimer: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitConnected(context.Background()); err == nil || c.Status() != CTimeout {
+		t.Errorf("WaitConnected returned %v with client %s, expected %s", err, c.Status(), CTimeout)
+	}
+	c.Close()
+}
+
+func TestWaitForFailsAfterFailedDial(t *testing.T) {
+	c, err := DialAndHandshakeAsync("nobody-listening", &ClientConfig{Transport: NewMemoryTransport(), Timeout: 20 * time.Millisecond, RetryTimer: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = c.WaitFor(ctx, func(status ClientStatus) bool { return status == CConnected })
+	if !errors.Is(err, errConnectTimeout) {
+		t.Errorf("WaitFor returned %v, expected the dial's %v", err, errConnectTimeout)
+	}
+	// CTimeout still leads to CClosed
+	go c.Close()
+	if err := c.WaitFor(ctx, func(status ClientStatus) bool { return status == CClosed }); err != nil {
+		t.Errorf("waiting for %s after %s: %v", CClosed, CTimeout, err)
+	}
+}
+
+// recordingHandler - a slog.Handler keeping the attributes of each record (including those added with Logger.With)
+type recordingHandler struct {
+	mutex   *sync.Mutex
+	records *[]map[string]any
+	attrs   []slog.Attr
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{mutex: &sync.Mutex{}, records: &[]map[string]any{}}
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordingHandler{mutex: h.mutex, records: h.records, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	record := map[string]any{"msg": r.Message}
+	for _, attr := range h.attrs {
+		record[attr.Key] = attr.Value.Any()
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		record[attr.Key] = attr.Value.Any()
+		return true
+	})
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	*h.records = append(*h.records, record)
+	return nil
+}
+
+// count returns the number of records with msg
+func (h *recordingHandler) count(msg string) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := 0
+	for _, record := range *h.records {
+		if record["msg"] == msg {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns the first record with msg whose attributes include attrs
+func (h *recordingHandler) find(msg string, attrs map[string]any) map[string]any {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+next:
+	for _, record := range *h.records {
+		if record["msg"] != msg {
+			continue
+		}
+		for key, value := range attrs {
+			if record[key] != value {
+				continue next
+			}
+		}
+		return record
+	}
+	return nil
+}
+
+func TestStatusChangesAreLogged(t *testing.T) {
+	transport := NewMemoryTransport()
+	handler := newRecordingHandler()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Logger: slog.New(handler), LogLevels: NewLogLevels(slog.LevelDebug)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Logger: slog.New(handler), LogLevels: NewLogLevels(slog.LevelDebug)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "server connected", func() bool { return s.Status() == SConnected })
+	c.Close()
+	s.Close()
+
+	expected := []map[string]any{
+		{"ipc": "test", "role": "server", "status": SConnected.String(), "old_status": SListening.String(), "session": uint64(1)},
+		{"ipc": "test", "role": "client", "status": CConnected.String(), "old_status": CConnecting.String(), "session": uint64(1)},
+		{"ipc": "test", "role": "client", "status": CClosed.String()},
+	}
+	for _, attrs := range expected {
+		if handler.find("status changed", attrs) == nil {
+			t.Errorf("no status change logged with %v", attrs)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const systemdListenFdsStart = 3
+
+// SystemdListeners - returns the listening sockets systemd passed to this process (socket activation),
+// keyed by their FileDescriptorName= from the .socket unit (LISTEN_FDNAMES, "unknown" if not set).
+// Sockets without FileDescriptorName= share the default name (the name of the socket unit), so each name maps to
+// its sockets in the order of the unit's Listen*= lines.
+//
+// Returns an empty map if the process hasn't been socket activated. The LISTEN_* environment variables are unset,
+// so child processes don't inherit them. Use the listener with StartServerWithListener:
+//
+//	listeners, err := ipc.SystemdListeners()
+//	s, err := ipc.StartServerWithListener("mydaemon", listeners["mydaemon"][0], nil)
+func SystemdListeners() (map[string][]net.Listener, error) {
+	return systemdListeners(systemdListenFdsStart)
+}
+
+// systemdListeners takes the LISTEN_FDS sockets, passed from fd firstFd on
+func systemdListeners(firstFd int) (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string][]net.Listener)
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil // not meant for this process
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, errors.New(fmt.Sprintf("invalid LISTEN_FDS '%s'", os.Getenv("LISTEN_FDS")))
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		fd := firstFd + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listen, err := net.FileListener(file) // dups the fd
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, errors.New(fmt.Sprintf("systemd socket '%s' (fd %d) is not a listening socket: %s", name, fd, err))
+		}
+		listeners[name] = append(listeners[name], listen)
+	}
+
+	return listeners, nil
+}
+
+func closeListeners(listeners map[string][]net.Listener) {
+	for _, named := range listeners {
+		for _, listen := range named {
+			listen.Close()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package ipc
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// passListeners puts the files on consecutive fds from firstFd on, as systemd does from fd 3 on
+func passListeners(t *testing.T, firstFd int, files ...*os.File) {
+	t.Helper()
+	for i, file := range files {
+		err := unix.Dup2(int(file.Fd()), firstFd+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		t.Cleanup(func() { unix.Close(firstFd + i) })
+	}
+}
+
+func listenerFile(t *testing.T) (*os.File, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, l.Addr().String()
+}
+
+func setListenEnv(t *testing.T, pid int, fds string, fdNames string) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	t.Setenv("LISTEN_FDS", fds)
+	t.Setenv("LISTEN_FDNAMES", fdNames)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	const firstFd = 200
+	first, firstAddr := listenerFile(t)
+	second, secondAddr := listenerFile(t)
+	passListeners(t, firstFd, first, second)
+	setListenEnv(t, os.Getpid(), "2", "control:")
+
+	listeners, err := systemdListeners(firstFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != 2 || len(listeners["control"]) != 1 || len(listeners["unknown"]) != 1 {
+		t.Fatalf("listeners %v", listeners)
+	}
+	if listeners["control"][0].Addr().String() != firstAddr || listeners["unknown"][0].Addr().String() != secondAddr {
+		t.Errorf("control on %s, unknown on %s", listeners["control"][0].Addr(), listeners["unknown"][0].Addr())
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, set := os.LookupEnv(env); set {
+			t.Errorf("%s is still set", env)
+		}
+	}
+}
+
+func TestSystemdListenersOfAnotherProcess(t *testing.T) {
+	setListenEnv(t, os.Getpid()+1, "1", "")
+	listeners, err := systemdListeners(200)
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("listeners %v, %v", listeners, err)
+	}
+}
+
+func TestSystemdListenersInvalid(t *testing.T) {
+	const firstFd = 200
+	setListenEnv(t, os.Getpid(), "x", "")
+	if _, err := systemdListeners(firstFd); err == nil {
+		t.Error("invalid LISTEN_FDS accepted")
+	}
+
+	notListening, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passListeners(t, firstFd, notListening)
+	setListenEnv(t, os.Getpid(), "1", "")
+	if _, err := systemdListeners(firstFd); err == nil {
+		t.Error("a file that isn't a listening socket accepted")
+	}
+}
+
+func TestSystemdListenersWithRepeatedNames(t *testing.T) {
+	const firstFd = 200
+	first, firstAddr := listenerFile(t)
+	second, secondAddr := listenerFile(t)
+	third, thirdAddr := listenerFile(t)
+	passListeners(t, firstFd, first, second, third)
+	// the default name of sockets without FileDescriptorName= is the unit's name
+	setListenEnv(t, os.Getpid(), "3", "mydaemon.socket:control:mydaemon.socket")
+
+	listeners, err := systemdListeners(firstFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	named := listeners["mydaemon.socket"]
+	if len(named) != 2 || len(listeners["control"]) != 1 {
+		t.Fatalf("listeners %v", listeners)
+	}
+	if named[0].Addr().String() != firstAddr || named[1].Addr().String() != thirdAddr || listeners["control"][0].Addr().String() != secondAddr {
+		t.Errorf("mydaemon.socket on %s and %s, control on %s", named[0].Addr(), named[1].Addr(), listeners["control"][0].Addr())
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package ipc
+
+import (
+	"errors"
+	"net"
+)
+
+// SystemdListeners - socket activation is not available on windows
+func SystemdListeners() (map[string][]net.Listener, error) {
+	return nil, errors.New("systemd socket activation is not supported on windows")
+}
@@ -0,0 +1,96 @@
+package ipc
+
+import "context"
+
+// Tracer - creates the spans of a Server or Client and propagates their context through the message Headers
+// (see ServerConfig.Tracer, ClientConfig.Tracer). It fits OpenTelemetry: Inject/Extract map to a TextMapPropagator
+// with a propagation.MapCarrier of the headers, Start to a trace.Tracer. Implementations must be safe for concurrent use.
+type Tracer interface {
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) // starts a span, a child of the span in ctx (if any)
+	Inject(ctx context.Context, headers map[string]string)                         // writes the span context of ctx into the headers of a message to send
+	Extract(ctx context.Context, headers map[string]string) context.Context        // returns ctx with the span context of a received message's headers
+}
+
+// Span - a span started by a Tracer
+type Span interface {
+	SetAttribute(key string, value any)
+	End(err error) // err: what the traced operation failed with (nil if successful)
+}
+
+// SpanKind - the role of a span, as in OpenTelemetry
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota // Send: the message is handed to the connection, the receiver processes it later
+	SpanKindConsumer                 // Receive: a message sent by the peer has been received
+	SpanKindServer                   // a Serve Handler processes a message
+)
+
+// names and attributes of the spans
+const (
+	spanSend           = "ipc.Send"
+	spanReceive        = "ipc.Receive"
+	spanHandle         = "ipc.Handle"
+	attributeIpcName   = "ipc.name"
+	attributeMsgType   = "ipc.msg_type"
+	attributeSessionID = "ipc.session_id"
+)
+
+// Context - the context of a received message, carrying the trace context the sender injected into its Headers (see Tracer).
+// context.Background() for messages that weren't received.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// startSendSpan starts the span of sending msg and injects its context into the message's headers
+func startSendSpan(tracer Tracer, ctx context.Context, ipcName string, msg *Message) Span {
+	if _, ok := tracer.(noTracer); ok {
+		return noSpan{}
+	}
+	ctx, span := tracer.Start(ctx, spanSend, SpanKindProducer)
+	span.SetAttribute(attributeIpcName, ipcName)
+	span.SetAttribute(attributeMsgType, int(msg.MsgType))
+
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	tracer.Inject(ctx, headers)
+	if len(headers) > 0 {
+		msg.Headers = headers
+	}
+	return span
+}
+
+// traceReceived sets the context of a received msg: a child of the sender's span (extracted from its headers) and of the receiving span
+func traceReceived(tracer Tracer, ctx context.Context, ipcName string, msg *Message) {
+	if _, ok := tracer.(noTracer); ok {
+		msg.ctx = ctx
+		return
+	}
+	ctx = tracer.Extract(ctx, msg.Headers)
+	ctx, span := tracer.Start(ctx, spanReceive, SpanKindConsumer)
+	span.SetAttribute(attributeIpcName, ipcName)
+	span.SetAttribute(attributeMsgType, int(msg.MsgType))
+	span.End(nil)
+	msg.ctx = ctx
+}
+
+// noTracer - the Tracer of servers and clients configured without
+type noTracer struct{}
+
+func (noTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	return ctx, noSpan{}
+}
+func (noTracer) Inject(context.Context, map[string]string) {}
+func (noTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	return ctx
+}
+
+type noSpan struct{}
+
+func (noSpan) SetAttribute(string, any) {}
+func (noSpan) End(error)                {}
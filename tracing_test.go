@@ -0,0 +1,172 @@
+package ipc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testTracer - propagates a trace ID and the ID of the parent span in the "trace" header
+type testTracer struct {
+	nextID atomic.Int64
+	mutex  sync.Mutex
+	spans  []*testSpan
+}
+
+type testSpan struct {
+	name   string
+	kind   SpanKind
+	trace  string
+	id     string
+	parent string
+	attrs  map[string]any
+	ended  bool
+	mutex  sync.Mutex
+}
+
+type spanKey struct{}
+
+func (tr *testTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	span := &testSpan{name: name, kind: kind, id: strconv.FormatInt(tr.nextID.Add(1), 10), attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		span.trace, span.parent = parent.trace, parent.id
+	} else {
+		span.trace = "trace-" + span.id
+	}
+	tr.mutex.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mutex.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (tr *testTracer) Inject(ctx context.Context, headers map[string]string) {
+	if span, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		headers["trace"] = span.trace + "/" + span.id
+	}
+}
+
+func (tr *testTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	for i := 0; i < len(headers["trace"]); i++ {
+		if headers["trace"][i] == '/' {
+			remote := &testSpan{trace: headers["trace"][:i], id: headers["trace"][i+1:]}
+			return context.WithValue(ctx, spanKey{}, remote)
+		}
+	}
+	return ctx
+}
+
+func (tr *testTracer) find(name string) []*testSpan {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	var found []*testSpan
+	for _, span := range tr.spans {
+		if span.name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func (span *testSpan) SetAttribute(key string, value any) {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.attrs[key] = value
+}
+
+func (span *testSpan) End(err error) {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.ended = true
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	headers := map[string]string{"tenant": "a", "empty": "", "trace": "0af7651916cd43dd8448eb211c80319c"}
+	msg, err := newReceivedMessage(messageWithHeaders, encodeMessageWithHeaders(Custom, headers, []byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgType != Custom || string(msg.Data) != "data" || len(msg.Headers) != len(headers) {
+		t.Fatalf("decoded %+v", msg)
+	}
+	for key, value := range headers {
+		if msg.Headers[key] != value {
+			t.Errorf("header %q is %q, expected %q", key, msg.Headers[key], value)
+		}
+	}
+
+	encoded := encodeMessageWithHeaders(Custom, headers, nil)
+	if _, err := decodeMessageWithHeaders(encoded[:len(encoded)-1]); err == nil {
+		t.Error("truncated headers must fail")
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	serverTracer, clientTracer := &testTracer{}, &testTracer{}
+	transport := NewMemoryTransport()
+	s, err := StartServer("test", &ServerConfig{Transport: transport, Encryption: true, Tracer: serverTracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(func(ctx context.Context, session *Session, msg *Message) {
+			session.SendContext(ctx, String, []byte("reply"))
+		})
+	}()
+	c, err := ClientDialAndHandshake("test", &ClientConfig{Transport: transport, Encryption: true, Tracer: clientTracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, request := clientTracer.Start(context.Background(), "request", SpanKindProducer)
+	if err := c.SendContext(ctx, String, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.Close()
+	<-served
+
+	trace := request.(*testSpan).trace
+	send := clientTracer.find(spanSend)
+	receive := serverTracer.find(spanReceive)
+	handle := serverTracer.find(spanHandle)
+	replySend := serverTracer.find(spanSend)
+	replyReceive := clientTracer.find(spanReceive)
+	if len(send) != 1 || len(receive) != 1 || len(handle) != 1 || len(replySend) != 1 || len(replyReceive) != 1 {
+		t.Fatalf("spans: %d send, %d receive, %d handle, %d reply send, %d reply receive", len(send), len(receive), len(handle), len(replySend), len(replyReceive))
+	}
+
+	chain := []struct {
+		span   *testSpan
+		parent *testSpan
+	}{
+		{send[0], request.(*testSpan)},
+		{receive[0], send[0]},
+		{handle[0], receive[0]},
+		{replySend[0], handle[0]},
+		{replyReceive[0], replySend[0]},
+	}
+	for _, link := range chain {
+		if link.span.trace != trace || link.span.parent != link.parent.id {
+			t.Errorf("span %s: trace %s parent %s, expected trace %s parent %s (%s)", link.span.name, link.span.trace, link.span.parent, trace, link.parent.id, link.parent.name)
+		}
+		if !link.span.ended {
+			t.Errorf("span %s has not ended", link.span.name)
+		}
+	}
+	if handle[0].kind != SpanKindServer || handle[0].attrs[attributeMsgType] != int(String) {
+		t.Errorf("handle span %+v", handle[0])
+	}
+	if span, ok := reply.Context().Value(spanKey{}).(*testSpan); !ok || span != replyReceive[0] {
+		t.Error("received message's context doesn't carry the receiving span")
+	}
+	if reply.Headers["trace"] == "" {
+		t.Error("received message has no trace header")
+	}
+}
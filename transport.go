@@ -0,0 +1,20 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Transport - creates the connections between client and server.
+//
+// name is the ipc name given to StartServer/ClientDialAndHandshake. Handshake, framing and encryption
+// happen on top of the returned connections, so any reliable, ordered byte stream will do.
+// Defaults are unix sockets on linux/mac and named pipes on windows.
+type Transport interface {
+	Listen(name string) (net.Listener, error)
+	Dial(ctx context.Context, name string) (net.Conn, error)
+}
+
+// ErrDialPermanent - Transport.Dial errors wrapping it stop the client from retrying to connect
+var ErrDialPermanent = errors.New("permanent dial error")
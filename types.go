@@ -1,8 +1,12 @@
 package ipc
 
 import (
-	"crypto/cipher"
+	"context"
+	"github.com/hoffigolang/golang-ipc/encryption"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -11,36 +15,50 @@ type Server struct {
 	Name                  string
 	listen                net.Listener // listener for connections
 	conn                  net.Conn     // socket/namedPipe connection to a client
-	status                ServerStatus
-	statusChannel         chan ServerStatus // reacting to Server status changes
+	connReader            *connReader  // reads from conn (collecting passed file descriptors)
+	connMutex             sync.Mutex   // guards taking over a connection after a successful handshake
+	pendingHandshakes     chan struct{}
+	state                 *statusMachine[ServerStatus]
+	log                   *slog.Logger
+	done                  chan struct{} // closed by Close
 	clientConnectionCount int
-	callback              func(ServerStatus)
-	incoming              chan *Message
-	outgoing              chan *Message
-	cipher                *cipher.AEAD
+	incoming              *messageQueue // received messages waiting for Receive
+	outgoing              *messageQueue // messages waiting for the writing goroutine
+	interceptors          interceptors
+	crypto                keyRotation
 	conf                  ServerConfig
+	manifestPath          string // published Manifest, removed on Close
 }
 
 // Client - holds the details of the client connection and config.
 type Client struct {
-	Name          string
-	conn          net.Conn // socket/namedPipe connection to server
-	status        ClientStatus
-	statusChannel chan ClientStatus // reacting to Client status changes
-	callback      func(ClientStatus)
-	incoming      chan *Message
-	outgoing      chan *Message
-	cipher        *cipher.AEAD
-	conf          ClientConfig
+	Name         string
+	conn         net.Conn    // socket/namedPipe connection to server
+	connReader   *connReader // reads from conn (collecting passed file descriptors)
+	connMutex    sync.Mutex  // guards replacing conn while reconnecting
+	state        *statusMachine[ClientStatus]
+	log          *slog.Logger
+	done         chan struct{} // closed by Close
+	incoming     *messageQueue // received messages waiting for Receive
+	outgoing     *messageQueue // messages waiting for the writing goroutine
+	interceptors interceptors
+	crypto       keyRotation
+	conf         ClientConfig
 }
 
 // Message - contains the received message or to send message
 type Message struct {
-	Err     error      // details of any error
-	IpcType IpcMsgType // if not 0 this is an Ipc specific message, not an ordinary message
-	MsgType MsgType    // 0 = reserved , <0 is an internal message (disconnection or error etc), all "normal" messages received will be > 0
-	Status  Status     // the connection status (mostly for internal IpcMsgType messages)
-	Data    []byte     // message data
+	Err     error             // details of any error
+	IpcType IpcMsgType        // if not 0 this is an Ipc specific message, not an ordinary message
+	MsgType MsgType           // 0 = reserved , <0 is an internal message (disconnection or error etc), all "normal" messages received will be > 0
+	Status  Status            // the connection status (mostly for internal IpcMsgType messages)
+	Data    []byte            // message data
+	Files   []*os.File        // files passed with SendFDs (unix sockets only), the receiver has to close them
+	Headers map[string]string // sent alongside the data, e.g. the trace context injected by a Tracer
+
+	sessionID uint64          // the server session the message was received from or is sent to (0: any)
+	queuedAt  time.Time       // when Send queued the message
+	ctx       context.Context // of a received message, see Context
 }
 
 type Status int
@@ -170,6 +188,16 @@ const (
 	Custom            // 6
 )
 
+// internal MsgTypes (<0) of frames exchanged between client and server, never handed to Receive()
+const (
+	messageWithHeaders MsgType = iota - 6 // -6 an ordinary message with Headers
+	handlerFailure                        // -5 the server's Handler failed on a message of the client, see Serve
+	messageWithFiles                      // -4 an ordinary message with file descriptors passed alongside
+	rekeyRequest                          // -3
+	rekeyResponse                         // -2
+	rekeyCommit                           // -1
+)
+
 func (mt MsgType) String() string {
 	return MsgTypeString(mt)
 }
@@ -228,8 +256,29 @@ const (
 	IpcVersionMismatch                                  // 1
 	ClientEncryptedServerNot                            // 2
 	ClientMaxMessageLengthTooBig                        // 3
+	NoCommonCipherSuite                                 // 4
+	HandshakeError                                      // 5 failed without a reason both sides know (e.g. I/O error, timeout), never sent
 )
 
+func (hr HandshakeResult) String() string {
+	switch hr {
+	case HandshakeOk:
+		return "HandshakeOk"
+	case IpcVersionMismatch:
+		return "IpcVersionMismatch"
+	case ClientEncryptedServerNot:
+		return "ClientEncryptedServerNot"
+	case ClientMaxMessageLengthTooBig:
+		return "ClientMaxMessageLengthTooBig"
+	case NoCommonCipherSuite:
+		return "NoCommonCipherSuite"
+	case HandshakeError:
+		return "HandshakeError"
+	default:
+		return "<Unknown>"
+	}
+}
+
 type Encryption byte
 
 const (
@@ -237,20 +286,72 @@ const (
 	Encrypted
 )
 
+// CipherSuite - the AEAD cipher used for an encrypted connection, negotiated during the handshake
+type CipherSuite = encryption.CipherSuite
+
+const (
+	AES256GCM        = encryption.AES256GCM
+	ChaCha20Poly1305 = encryption.ChaCha20Poly1305 // faster than AES on hardware without AES instructions
+)
+
+func containsCipherSuite(suites []CipherSuite, suite CipherSuite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
 // ServerConfig - used to pass configuration overrides to ServerStart()
 type ServerConfig struct {
-	SocketBasePath    string
-	Timeout           time.Duration
-	MaxMsgSize        int
-	Encryption        bool
+	SocketBasePath       string
+	Timeout              time.Duration
+	MaxMsgSize           int
+	Encryption           bool
+	CipherSuites         []CipherSuite  // cipher suites the server accepts, the client chooses from these
+	HandshakeTimeout     time.Duration  // the whole handshake with a connecting client has to finish within this duration
+	MaxPendingHandshakes int            // clients connecting while this many handshakes are in progress get rejected
+	SocketFileMode       os.FileMode    // unix socket file permissions, e.g. 0660 (0: as created with the process' umask); on windows any world-writable mode lets every authenticated user connect
+	SocketOwner          string         // user name or uid to chown the unix socket file to ("": unchanged)
+	SocketGroup          string         // group name or gid to chown the unix socket file to ("": unchanged)
+	ServeWorkers         int            // goroutines running the Handler in Serve (default runtime.NumCPU())
+	ServeInOrder         bool           // Serve hands the messages of a session to the Handler one after another, in the order received
+	Capabilities         []string       // published in the server's Manifest, clients can find the server by them (see Discover)
+	AbstractSocket       bool           // linux only: listen on the abstract unix socket @golang-ipc/<ipc name>.sock, see UnixSocketTransport
+	Transport            Transport      // nil: unix socket/named pipe in SocketBasePath
+	Metrics              Metrics        // receives the server's measurements (nil: none), see package ipcmetrics
+	Logger               *slog.Logger   // logs of the server (nil: slog.Default(), whose handler level LogLevels override), it never terminates the process
+	LogLevels            *LogLevels     // minimum levels of the server's logs, overall and per Subsystem, changeable at runtime (nil: LogLevelsFromEnv())
+	Tracer               Tracer         // creates spans for Send, Receive and Serve's Handler calls and propagates them to the client (nil: none)
+	IncomingQueueSize    int            // received messages buffered until Receive takes them (0: none, reading waits for Receive)
+	OutgoingQueueSize    int            // sent messages buffered until they are written (0: none, Send waits for the writing goroutine)
+	IncomingOverflow     OverflowPolicy // what happens to received messages when the incoming queue is full (default OverflowBlock, the only policy for a queue of size 0)
+	OutgoingOverflow     OverflowPolicy // what happens to sent messages when the outgoing queue is full (default OverflowBlock, the only policy for a queue of size 0)
+
+	// Deprecated: use SocketFileMode 0666 instead. Makes the socket writable for any user if SocketFileMode is not set.
 	UnmaskPermissions bool
 }
 
 // ClientConfig - used to pass configuration overrides to ClientStart()
 type ClientConfig struct {
-	SocketBasePath string
-	Timeout        time.Duration
-	RetryTimer     time.Duration
-	MaxMsgSize     int
-	Encryption     bool
+	SocketBasePath     string
+	Timeout            time.Duration
+	RetryTimer         time.Duration
+	MaxMsgSize         int
+	Encryption         bool
+	CipherSuites       []CipherSuite  // cipher suites in order of preference, the first one the server also supports is used
+	HandshakeTimeout   time.Duration  // the whole handshake with the server has to finish within this duration
+	RekeyAfterFrames   uint64         // rotate the session key after this many frames (sent + received) with the same key
+	RekeyAfterDuration time.Duration  // rotate the session key after it has been in use for this long
+	AbstractSocket     bool           // linux only: dial the abstract unix socket @golang-ipc/<ipc name>.sock, see UnixSocketTransport
+	Transport          Transport      // nil: unix socket/named pipe in SocketBasePath
+	Metrics            Metrics        // receives the client's measurements (nil: none), see package ipcmetrics
+	Logger             *slog.Logger   // logs of the client (nil: slog.Default(), whose handler level LogLevels override), it never terminates the process
+	LogLevels          *LogLevels     // minimum levels of the client's logs, overall and per Subsystem, changeable at runtime (nil: LogLevelsFromEnv())
+	Tracer             Tracer         // creates spans for Send and Receive and propagates them to the server (nil: none)
+	IncomingQueueSize  int            // received messages buffered until Receive takes them (0: none, reading waits for Receive)
+	OutgoingQueueSize  int            // sent messages buffered until they are written (0: none, Send waits for the writing goroutine)
+	IncomingOverflow   OverflowPolicy // what happens to received messages when the incoming queue is full (default OverflowBlock, the only policy for a queue of size 0)
+	OutgoingOverflow   OverflowPolicy // what happens to sent messages when the outgoing queue is full (default OverflowBlock, the only policy for a queue of size 0)
 }
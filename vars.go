@@ -1,8 +1,11 @@
 package ipc
 
-import "time"
+import (
+	"runtime"
+	"time"
+)
 
-const ipcVersion = 2 // ipc ipcVersion for assuring message compatibility
+const ipcVersion = 4 // ipc ipcVersion for assuring message compatibility
 const FinalMessage = "°§°finalMessage°§°"
 const IntermediateActionMessage = "°§°aaaaandAction°§°"
 const InitialMessage = "°§°initialMessage°§°"
@@ -10,15 +13,28 @@ const (
 	minMsgSize        = 1024
 	defaultMaxMsgSize = 3145728 // 3Mb  - Maximum bytes allowed for each message
 	defaultRetryTimer = time.Duration(200 * time.Millisecond)
+
+	defaultHandshakeTimeout     = 10 * time.Second
+	defaultMaxPendingHandshakes = 8
+
+	defaultRekeyAfterFrames   = 1 << 30 // well below the 2^32 AES-GCM invocations with random nonces per key
+	defaultRekeyAfterDuration = 24 * time.Hour
 )
 
 var (
+	DefaultCipherSuites = []CipherSuite{AES256GCM, ChaCha20Poly1305}
+
 	DefaultServerConfig = ServerConfig{
-		SocketBasePath:    defaultSocketBasePath,
-		Timeout:           0,
-		MaxMsgSize:        defaultMaxMsgSize,
-		Encryption:        false,
-		UnmaskPermissions: true,
+		SocketBasePath:   defaultSocketBasePath,
+		Timeout:          0,
+		MaxMsgSize:       defaultMaxMsgSize,
+		Encryption:       false,
+		CipherSuites:     DefaultCipherSuites,
+		HandshakeTimeout: defaultHandshakeTimeout,
+
+		MaxPendingHandshakes: defaultMaxPendingHandshakes,
+		SocketFileMode:       0666,
+		ServeWorkers:         runtime.NumCPU(),
 	}
 
 	DefaultClientConfig = ClientConfig{
@@ -27,5 +43,10 @@ var (
 		RetryTimer:     defaultRetryTimer,
 		MaxMsgSize:     defaultMaxMsgSize,
 		Encryption:     false,
+		CipherSuites:   DefaultCipherSuites,
+
+		HandshakeTimeout:   defaultHandshakeTimeout,
+		RekeyAfterFrames:   defaultRekeyAfterFrames,
+		RekeyAfterDuration: defaultRekeyAfterDuration,
 	}
 )